@@ -0,0 +1,167 @@
+// Package agent is the lambda side: it connects back to the server over ssh
+// and serves the proxy protocol on the yamux streams of the tunnel.
+package agent
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/elazarl/goproxy"
+    "github.com/ginuerzh/gost"
+    "github.com/hashicorp/yamux"
+    "golang.org/x/crypto/ssh"
+    "lambdaproxy/wire"
+)
+
+const (
+    _IPLookupTimeout = 10 * time.Second
+)
+
+func ConnectSSH(host, user, key string) (*ssh.Client, error) {
+    signer, err := ssh.ParsePrivateKey([]byte(key))
+    if err != nil {
+        return nil, err
+    }
+    return ssh.Dial("tcp", host, &ssh.ClientConfig{
+        User:            user,
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+        Auth: []ssh.AuthMethod{
+            ssh.PublicKeys(signer),
+        },
+    })
+}
+
+func GetTunnel(client *ssh.Client, tunnel string) (*yamux.Session, error) {
+    service, err := client.Dial("tcp", tunnel)
+    if err != nil {
+        return nil, err
+    }
+
+    return yamux.Server(service, nil)
+}
+
+// NewHttpServer returns the http proxy of the http mode. Every dial goes
+// through egress, targets denied up front are answered with 403, and plain
+// requests go through headers.
+func NewHttpServer(egress *Egress, headers *HeaderFilter) *http.Server {
+    proxy := goproxy.NewProxyHttpServer()
+    proxy.Tr.DialContext = egress.DialContext
+    proxy.ConnectDial = egress.Dial
+
+    proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+        err := egress.Check(ctx.Req.Context(), host)
+        if errors.Is(err, ErrEgressDenied) {
+            log.Printf("%v", err)
+            ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, err.Error())
+            return goproxy.RejectConnect, host
+        }
+        return goproxy.OkConnect, host
+    })
+    proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+        host := r.URL.Host
+        if _, _, err := net.SplitHostPort(host); err != nil {
+            host = net.JoinHostPort(host, "80")
+        }
+        err := egress.Check(r.Context(), host)
+        if errors.Is(err, ErrEgressDenied) {
+            log.Printf("%v", err)
+            return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, err.Error())
+        }
+        headers.Filter(r.Header)
+        return r, nil
+    })
+    return &http.Server{Handler: proxy}
+}
+
+// LookupIP asks the echo services in turn for the public ip of the
+// function, or of the last upstream proxy if there is a chain. The first
+// valid answer wins.
+func LookupIP(urls []string, upstream *gost.Chain) (string, error) {
+    if len(urls) == 0 {
+        return "", errors.New("no ip urls")
+    }
+
+    client := &http.Client{Timeout: _IPLookupTimeout}
+    if upstream != nil {
+        client.Transport = &http.Transport{
+            DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                return upstream.DialContext(ctx, network, addr)
+            },
+        }
+    }
+    var errs []error
+    for _, v := range urls {
+        resp, err := client.Get(v)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+        resp.Body.Close()
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        ip := strings.TrimSpace(string(body))
+        if resp.StatusCode != http.StatusOK || net.ParseIP(ip) == nil {
+            errs = append(errs, fmt.Errorf("%s answered %s", v, resp.Status))
+            continue
+        }
+        return ip, nil
+    }
+    return "", errors.Join(errs...)
+}
+
+// HandleRequest connects back whatever the request version, the server
+// finds out in the handshake whether this agent can serve it.
+func HandleRequest(req wire.Request) error {
+    if req.Version > wire.Version {
+        log.Printf("server speaks protocol version %d, this agent %d", req.Version, wire.Version)
+    }
+
+    egress, err := NewEgress(req.Egress, req.Upstream)
+    if err != nil {
+        return err
+    }
+    headers := NewHeaderFilter(req.Headers)
+    handler, err := NewStreamHandler(req.Mode, req.Forward, egress, headers)
+    if err != nil {
+        return err
+    }
+    if closer, ok := handler.(io.Closer); ok {
+        defer closer.Close()
+    }
+
+    log.Printf("new proxy request, connecting to %s", req.Host)
+    client, err := ConnectSSH(req.Host, req.User, req.Key)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+
+    log.Printf("establishing tunnel on %s", req.Tunnel)
+    tunnel, err := GetTunnel(client, req.Tunnel)
+    if err != nil {
+        return err
+    }
+    defer tunnel.Close()
+
+    log.Printf("starting %s proxy server", wire.ModeName(req.Mode))
+    startTime := time.Now()
+
+    defer func() {
+        runtime := time.Since(startTime).String()
+        log.Printf("closing proxy server after %s", runtime)
+    }()
+    if ServeStreams(tunnel, handler, egress, headers, req.IPUrls, AgentHello(&req)) {
+        return nil
+    }
+    return errors.New("tunnel closed")
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "lambdaproxy/wire"
+)
+
+const (
+    _DnsTimeout = 5 * time.Second
+)
+
+// ResolvConf lists the nameservers dns queries are forwarded to.
+var ResolvConf = "/etc/resolv.conf"
+
+// ServeDns answers the dns messages of stream from the nameservers of the
+// function, so names resolve like they do for its own dials. The egress
+// policy doesn't apply, the nameservers are link local in lambda.
+func ServeDns(stream net.Conn, reader *bufio.Reader) {
+    defer stream.Close()
+
+    req, err := http.ReadRequest(reader)
+    if err != nil {
+        return
+    }
+    req.Body.Close()
+
+    servers, err := Nameservers(ResolvConf)
+    if err != nil {
+        _ = wire.WriteError(stream, err)
+        return
+    }
+    err = wire.WriteResponse(stream, nil)
+    if err != nil {
+        return
+    }
+
+    for {
+        query, err := wire.ReadDnsMessage(reader)
+        if err != nil {
+            return
+        }
+        answer, err := ForwardDns(query, servers)
+        if err != nil {
+            log.Printf("dns: %v", err)
+        }
+        // an empty answer has the server reply servfail
+        err = wire.WriteDnsMessage(stream, answer)
+        if err != nil {
+            return
+        }
+    }
+}
+
+// Nameservers reads the nameserver addresses of a resolv.conf, a
+// host:port nameserver keeps its port.
+func Nameservers(path string) ([]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var servers []string
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 2 || fields[0] != "nameserver" {
+            continue
+        }
+        if _, _, err := net.SplitHostPort(fields[1]); err == nil {
+            servers = append(servers, fields[1])
+        } else {
+            servers = append(servers, net.JoinHostPort(fields[1], "53"))
+        }
+    }
+    if len(servers) == 0 {
+        return nil, fmt.Errorf("no nameserver in %s", path)
+    }
+    return servers, nil
+}
+
+// ForwardDns asks the servers in turn over udp, again over tcp when the
+// answer is truncated.
+func ForwardDns(query []byte, servers []string) ([]byte, error) {
+    if len(query) < 12 {
+        return nil, errors.New("short dns query")
+    }
+    var errs []error
+    for _, server := range servers {
+        answer, err := ExchangeDns("udp", server, query)
+        if err == nil && answer[2]&0x02 != 0 {
+            answer, err = ExchangeDns("tcp", server, query)
+        }
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        return answer, nil
+    }
+    return nil, errors.Join(errs...)
+}
+
+func ExchangeDns(network, server string, query []byte) ([]byte, error) {
+    conn, err := net.DialTimeout(network, server, _DnsTimeout)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    _ = conn.SetDeadline(time.Now().Add(_DnsTimeout))
+
+    var answer []byte
+    if network == "tcp" {
+        err = wire.WriteDnsMessage(conn, query)
+        if err == nil {
+            answer, err = wire.ReadDnsMessage(conn)
+        }
+    } else {
+        _, err = conn.Write(query)
+        if err == nil {
+            buf := make([]byte, wire.MaxDatagramSize)
+            var n int
+            n, err = conn.Read(buf)
+            answer = buf[:n]
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+    if len(answer) < 12 || answer[0] != query[0] || answer[1] != query[1] {
+        return nil, fmt.Errorf("bad dns answer from %s", server)
+    }
+    return answer, nil
+}
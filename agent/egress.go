@@ -0,0 +1,274 @@
+package agent
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/wire"
+)
+
+const (
+    _EgressDialTimeout = 10 * time.Second
+)
+
+var ErrEgressDenied = errors.New("egress denied")
+
+type PortRange struct {
+    Min_ int
+    Max_ int
+}
+
+// Egress decides which targets the agent may dial. Names are resolved here
+// and every address is checked again at dial time, so a name can't point
+// the agent at a denied address after the check. With an Upstream_ chain
+// the agent only reaches the first proxy, tcp targets are dialed through
+// the chain unresolved and only the allow lists and literal addresses are
+// checked.
+type Egress struct {
+    Deny_     []*net.IPNet
+    Domains_  []string
+    Ports_    []PortRange
+    Upstream_ *gost.Chain
+}
+
+func NewEgress(policy *wire.EgressPolicy, upstream []string) (*Egress, error) {
+    egress := new(Egress)
+    var err error
+    egress.Upstream_, err = NewUpstreamChain(upstream)
+    if err != nil {
+        return nil, err
+    }
+    if policy == nil {
+        return egress, nil
+    }
+
+    for _, cidr := range policy.DenyCidrs {
+        _, ipNet, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, fmt.Errorf("bad deny cidr %q", cidr)
+        }
+        egress.Deny_ = append(egress.Deny_, ipNet)
+    }
+    for _, domain := range policy.AllowDomains {
+        egress.Domains_ = append(egress.Domains_, strings.TrimPrefix(strings.ToLower(domain), "."))
+    }
+    for _, ports := range policy.AllowPorts {
+        min, max, isRange := strings.Cut(ports, "-")
+        if !isRange {
+            max = min
+        }
+        portMin, err := strconv.Atoi(min)
+        if err != nil {
+            return nil, fmt.Errorf("bad allow port %q", ports)
+        }
+        portMax, err := strconv.Atoi(max)
+        if err != nil || portMin > portMax {
+            return nil, fmt.Errorf("bad allow port %q", ports)
+        }
+        egress.Ports_ = append(egress.Ports_, PortRange{Min_: portMin, Max_: portMax})
+    }
+    return egress, nil
+}
+
+func (self *Egress) AllowedIP(ip net.IP) bool {
+    for _, ipNet := range self.Deny_ {
+        if ipNet.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+func (self *Egress) AllowedPort(port int) bool {
+    if len(self.Ports_) == 0 {
+        return true
+    }
+    for _, ports := range self.Ports_ {
+        if port >= ports.Min_ && port <= ports.Max_ {
+            return true
+        }
+    }
+    return false
+}
+
+// AllowedHost checks the allow list. Addresses only pass an allow list
+// when they are listed themselves.
+func (self *Egress) AllowedHost(host string) bool {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    if ip := net.ParseIP(host); ip != nil && !self.AllowedIP(ip) {
+        return false
+    }
+    if len(self.Domains_) == 0 {
+        return true
+    }
+    for _, domain := range self.Domains_ {
+        if host == domain || strings.HasSuffix(host, "."+domain) {
+            return true
+        }
+    }
+    return false
+}
+
+// CheckTarget checks the port and host of a host:port target without
+// resolving it.
+func (self *Egress) CheckTarget(ctx context.Context, addr string) (string, int, error) {
+    host, sport, err := net.SplitHostPort(addr)
+    if err != nil {
+        return "", 0, err
+    }
+    port, err := strconv.Atoi(sport)
+    if err != nil {
+        port, err = net.DefaultResolver.LookupPort(ctx, "tcp", sport)
+        if err != nil {
+            return "", 0, err
+        }
+    }
+    if !self.AllowedPort(port) || !self.AllowedHost(host) {
+        return "", 0, fmt.Errorf("%w: %s", ErrEgressDenied, addr)
+    }
+    return host, port, nil
+}
+
+// Check tells whether a tcp target may be dialed, resolving it unless an
+// upstream does.
+func (self *Egress) Check(ctx context.Context, addr string) error {
+    if self.Upstream_ != nil {
+        _, _, err := self.CheckTarget(ctx, addr)
+        return err
+    }
+    _, err := self.Resolve(ctx, addr)
+    return err
+}
+
+// Resolve checks a host:port target and returns the addresses it may dial.
+func (self *Egress) Resolve(ctx context.Context, addr string) ([]string, error) {
+    host, port, err := self.CheckTarget(ctx, addr)
+    if err != nil {
+        return nil, err
+    }
+
+    ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return nil, err
+    }
+    var addrs []string
+    for _, ip := range ips {
+        if self.AllowedIP(ip.IP) {
+            addrs = append(addrs, net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)))
+        }
+    }
+    if len(addrs) == 0 {
+        return nil, fmt.Errorf("%w: %s resolves to denied addresses", ErrEgressDenied, addr)
+    }
+    return addrs, nil
+}
+
+func (self *Egress) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    if self.Upstream_ != nil {
+        _, _, err := self.CheckTarget(ctx, addr)
+        if err != nil {
+            return nil, err
+        }
+        return self.Upstream_.DialContext(ctx, network, addr, gost.TimeoutChainOption(_EgressDialTimeout))
+    }
+
+    addrs, err := self.Resolve(ctx, addr)
+    if err != nil {
+        return nil, err
+    }
+
+    dialer := &net.Dialer{Timeout: _EgressDialTimeout}
+    for _, v := range addrs {
+        var conn net.Conn
+        conn, err = dialer.DialContext(ctx, network, v)
+        if err == nil {
+            return conn, nil
+        }
+    }
+    return nil, err
+}
+
+func (self *Egress) Dial(network, addr string) (net.Conn, error) {
+    return self.DialContext(context.Background(), network, addr)
+}
+
+// HandlerOptions make the gost handler answer denied targets with 403 or
+// the socks "not allowed" reply, and dial everything else through egress.
+func (self *Egress) HandlerOptions() ([]gost.HandlerOption, error) {
+    options := []gost.HandlerOption{
+        gost.BypassHandlerOption(gost.NewBypass(false, &EgressMatcher{Egress_: self})),
+        gost.ChainHandlerOption(gost.NewChain(gost.Node{
+            ID:   1,
+            Addr: "egress",
+            Client: &gost.Client{
+                Connector:   &EgressConnector{Egress_: self},
+                Transporter: &EgressTransporter{},
+            },
+        })),
+    }
+
+    if len(self.Ports_) > 0 {
+        var ports []string
+        for _, v := range self.Ports_ {
+            ports = append(ports, fmt.Sprintf("%d-%d", v.Min_, v.Max_))
+        }
+        whitelist, err := gost.ParsePermissions("tcp:*:" + strings.Join(ports, ","))
+        if err != nil {
+            return nil, err
+        }
+        options = append(options, gost.WhitelistHandlerOption(whitelist))
+    }
+    return options, nil
+}
+
+// EgressMatcher matches the hosts the policy denies without resolving them,
+// resolved addresses are checked when dialing.
+type EgressMatcher struct {
+    Egress_ *Egress
+}
+
+func (self *EgressMatcher) Match(host string) bool {
+    return !self.Egress_.AllowedHost(host)
+}
+
+func (self *EgressMatcher) String() string {
+    return "egress"
+}
+
+// EgressTransporter and EgressConnector stand in for a proxy hop so the gost
+// handler dials targets through Egress instead of net.Dial.
+type EgressTransporter struct {
+}
+
+func (self *EgressTransporter) Dial(addr string, options ...gost.DialOption) (net.Conn, error) {
+    client, server := net.Pipe()
+    server.Close()
+    return client, nil
+}
+
+func (self *EgressTransporter) Handshake(conn net.Conn, options ...gost.HandshakeOption) (net.Conn, error) {
+    return conn, nil
+}
+
+func (self *EgressTransporter) Multiplex() bool {
+    return false
+}
+
+type EgressConnector struct {
+    Egress_ *Egress
+}
+
+func (self *EgressConnector) Connect(conn net.Conn, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    return self.ConnectContext(context.Background(), conn, "tcp", address, options...)
+}
+
+func (self *EgressConnector) ConnectContext(ctx context.Context, conn net.Conn, network, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    conn.Close()
+    return self.Egress_.DialContext(ctx, network, address)
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    "lambdaproxy/wire"
+)
+
+func TestEgressCheck(t *testing.T) {
+    policy := &wire.EgressPolicy{
+        DenyCidrs:    []string{"10.0.0.0/8", "127.0.0.0/8", "fc00::/7"},
+        AllowDomains: []string{".example.com", "localhost", "192.0.2.1", "10.1.2.3", "2001:db8::1", "fd00::1"},
+        AllowPorts:   []string{"80", "443", "8000-8999"},
+    }
+    egress, err := NewEgress(policy, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        Addr    string
+        Allowed bool
+    }{
+        {"192.0.2.1:80", true},
+        {"192.0.2.1:8080", true},
+        {"192.0.2.1:http", true},
+        {"192.0.2.1:22", false},
+        {"192.0.2.2:80", false},
+        {"10.1.2.3:80", false},
+        {"[2001:db8::1]:443", true},
+        {"[fd00::1]:443", false},
+        {"other.org:80", false},
+        {"example.com.evil.org:80", false},
+        // resolved, and the address is denied
+        {"localhost:80", false},
+    }
+    for _, test := range tests {
+        err := egress.Check(context.Background(), test.Addr)
+        if test.Allowed != (err == nil) {
+            t.Errorf("%s: %v", test.Addr, err)
+        }
+        if err != nil && !errors.Is(err, ErrEgressDenied) {
+            t.Errorf("%s: %v is not a denial", test.Addr, err)
+        }
+    }
+
+    // an upstream resolves the names, only the lists are checked
+    egress, err = NewEgress(policy, []string{"http://127.0.0.1:3128"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = egress.Check(context.Background(), "localhost:80"); err != nil {
+        t.Errorf("localhost through upstream: %v", err)
+    }
+    if err = egress.Check(context.Background(), "10.1.2.3:80"); !errors.Is(err, ErrEgressDenied) {
+        t.Errorf("denied address through upstream: %v", err)
+    }
+}
+
+func TestNewEgress(t *testing.T) {
+    bad := []*wire.EgressPolicy{
+        {DenyCidrs: []string{"10.0.0.1"}},
+        {AllowPorts: []string{"web"}},
+        {AllowPorts: []string{"443-80"}},
+    }
+    for _, policy := range bad {
+        if _, err := NewEgress(policy, nil); err == nil {
+            t.Errorf("policy %+v accepted", policy)
+        }
+    }
+    egress, err := NewEgress(nil, nil)
+    if err != nil || egress.Check(context.Background(), "127.0.0.1:22") != nil {
+        t.Errorf("no policy denies: %v", err)
+    }
+}
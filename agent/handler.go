@@ -0,0 +1,296 @@
+package agent
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+
+    "github.com/ginuerzh/gost"
+    "github.com/hashicorp/yamux"
+    "lambdaproxy/wire"
+)
+
+// AgentHello is what this agent answers the handshake of req with. Udp and
+// dns can't go through an upstream, with one they are only offered if the
+// server allows them to leave the lambda directly.
+func AgentHello(req *wire.Request) *wire.Hello {
+    hello := &wire.Hello{
+        Version: wire.Version,
+        Capabilities: []string{
+            wire.ModeHttp, wire.ModeSocks5, wire.ModeAuto, wire.ModeForward,
+            wire.CapEgress, wire.CapExit, wire.CapIP, wire.CapDial, wire.CapHeaders, wire.CapUpstream,
+        },
+    }
+    if len(req.Upstream) == 0 || req.DirectUdp {
+        hello.Capabilities = append(hello.Capabilities, wire.CapUdp, wire.CapDns)
+    }
+    return hello
+}
+
+// StreamHandler serves one tunnel stream, gost.Handler is one.
+type StreamHandler interface {
+    Handle(net.Conn)
+}
+
+// NewStreamHandler picks the protocol the server speaks on the streams.
+// Every mode dials through egress.
+func NewStreamHandler(mode string, forward string, egress *Egress, headers *HeaderFilter) (StreamHandler, error) {
+    var handler gost.Handler
+    switch mode {
+    case "", wire.ModeHttp:
+        return NewHttpHandler(egress, headers), nil
+    case wire.ModeForward:
+        if forward == "" {
+            return nil, fmt.Errorf("mode %s without a forward target", mode)
+        }
+        return &ForwardHandler{Target_: forward, Egress_: egress}, nil
+    case wire.ModeSocks5:
+        handler = gost.SOCKS5Handler()
+    case wire.ModeAuto:
+        handler = gost.AutoHandler()
+    default:
+        return nil, fmt.Errorf("unknown mode %q", mode)
+    }
+
+    options, err := egress.HandlerOptions()
+    if err != nil {
+        return nil, err
+    }
+    handler.Init(options...)
+    return handler, nil
+}
+
+// HttpHandler feeds the streams to an http.Server running the goproxy
+// proxy, so keep-alive streams carry several requests.
+type HttpHandler struct {
+    Listener_ *StreamListener
+}
+
+func NewHttpHandler(egress *Egress, headers *HeaderFilter) *HttpHandler {
+    listener := NewStreamListener()
+    go func() {
+        err := NewHttpServer(egress, headers).Serve(listener)
+        if err != nil && err != net.ErrClosed {
+            log.Printf("http proxy stopped: %v", err)
+        }
+    }()
+    return &HttpHandler{Listener_: listener}
+}
+
+func (self *HttpHandler) Handle(conn net.Conn) {
+    self.Listener_.Push(conn)
+}
+
+func (self *HttpHandler) Close() error {
+    return self.Listener_.Close()
+}
+
+// StreamListener is a net.Listener handing out pushed connections.
+type StreamListener struct {
+    Conns_     chan net.Conn
+    Done_      chan struct{}
+    CloseOnce_ sync.Once
+}
+
+func NewStreamListener() *StreamListener {
+    return &StreamListener{
+        Conns_: make(chan net.Conn),
+        Done_:  make(chan struct{}),
+    }
+}
+
+func (self *StreamListener) Push(conn net.Conn) {
+    select {
+    case self.Conns_ <- conn:
+    case <-self.Done_:
+        conn.Close()
+    }
+}
+
+func (self *StreamListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-self.Conns_:
+        return conn, nil
+    case <-self.Done_:
+        return nil, net.ErrClosed
+    }
+}
+
+func (self *StreamListener) Close() error {
+    self.CloseOnce_.Do(func() { close(self.Done_) })
+    return nil
+}
+
+func (self *StreamListener) Addr() net.Addr {
+    return &net.TCPAddr{}
+}
+
+// ForwardHandler pipes every stream to one fixed target.
+type ForwardHandler struct {
+    Target_ string
+    Egress_ *Egress
+}
+
+func (self *ForwardHandler) Handle(conn net.Conn) {
+    target, err := self.Egress_.Dial("tcp", self.Target_)
+    if err != nil {
+        log.Printf("forward to %s: %v", self.Target_, err)
+        conn.Close()
+        return
+    }
+    BidirectionalCopy(conn, target)
+}
+
+// ServeDial dials the target of the stream header through egress whatever
+// the mode, the server already spoke the proxy protocol with its client.
+// Plain http requests go through headers.
+func ServeDial(conn net.Conn, egress *Egress, headers *HeaderFilter) {
+    header, err := wire.ReadStreamHeader(conn)
+    if err != nil {
+        log.Printf("bad stream header: %v", err)
+        conn.Close()
+        return
+    }
+    target, err := egress.Dial("tcp", header.Target)
+    if err != nil {
+        log.Printf("dial %s user=%s flags=%#x: %v", header.Target, header.User, header.Flags, err)
+        code := byte(wire.DialFailed)
+        if errors.Is(err, ErrEgressDenied) {
+            code = wire.DialDenied
+        }
+        _ = wire.WriteDialReply(conn, code)
+        conn.Close()
+        return
+    }
+    err = wire.WriteDialReply(conn, wire.DialOk)
+    if err != nil {
+        target.Close()
+        conn.Close()
+        return
+    }
+    if header.Flags&wire.FlagHttp != 0 {
+        headers.Relay(conn, target)
+        return
+    }
+    BidirectionalCopy(conn, target)
+}
+
+func BidirectionalCopy(src io.ReadWriteCloser, dst io.ReadWriteCloser) {
+    defer dst.Close()
+    defer src.Close()
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        _, err := io.Copy(dst, src)
+        dst.Close()
+        if err != nil {
+            log.Printf("io copy dst to src: %+v", err)
+        }
+        wg.Done()
+    }()
+
+    wg.Add(1)
+    go func() {
+        _, err := io.Copy(src, dst)
+        src.Close()
+        if err != nil {
+            log.Printf("io copy src to dst: %+v", err)
+        }
+        wg.Done()
+    }()
+    wg.Wait()
+}
+
+// RefuseControl answers the control request on stream with err.
+func RefuseControl(stream net.Conn, reader *bufio.Reader, err error) {
+    defer stream.Close()
+
+    req, rerr := http.ReadRequest(reader)
+    if rerr != nil {
+        return
+    }
+    req.Body.Close()
+    _ = wire.WriteError(stream, err)
+}
+
+type BufferedConn struct {
+    net.Conn
+    Reader_ *bufio.Reader
+}
+
+func (self *BufferedConn) Read(b []byte) (int, error) {
+    return self.Reader_.Read(b)
+}
+
+// ServeStreams hands every stream the server opens to handler until the
+// session ends, answering the handshake with hello, the ip request from
+// ipUrls and relaying udp associations through egress. The udp and dns
+// requests are refused unless hello offers them. It returns true if the
+// server asked us to exit.
+func ServeStreams(tunnelSess *yamux.Session, handler StreamHandler, egress *Egress, headers *HeaderFilter, ipUrls []string, hello *wire.Hello) bool {
+    exit := make(chan struct{})
+    var exitOnce sync.Once
+
+    for {
+        tunnelStream, err := tunnelSess.Accept()
+        if err != nil {
+            select {
+            case <-exit:
+                return true
+            default:
+            }
+            log.Printf("Failed to accept stream: %v", err)
+            return false
+        }
+
+        go func(stream net.Conn) {
+            reader := bufio.NewReader(stream)
+            if wire.PeekStreamHeader(reader) {
+                ServeDial(&BufferedConn{Conn: stream, Reader_: reader}, egress, headers)
+                return
+            }
+            switch wire.PeekControl(reader) {
+            case wire.HelloPath:
+                _ = wire.WriteHello(stream, hello)
+                stream.Close()
+            case wire.IPPath:
+                ip, err := LookupIP(ipUrls, egress.Upstream_)
+                if err != nil {
+                    _ = wire.WriteError(stream, err)
+                } else {
+                    _ = wire.WriteJson(stream, &wire.IPReport{IP: ip})
+                }
+                stream.Close()
+            case wire.UdpPath:
+                if !hello.Has(wire.CapUdp) {
+                    RefuseControl(stream, reader, wire.ErrUdpBypass)
+                    return
+                }
+                ServeUdp(stream, reader, egress)
+            case wire.DnsPath:
+                if !hello.Has(wire.CapDns) {
+                    RefuseControl(stream, reader, wire.ErrUdpBypass)
+                    return
+                }
+                ServeDns(stream, reader)
+            case wire.ExitPath:
+                // the server asks us to exit over the tunnel on shutdown so
+                // the function stops billing instead of running until its
+                // timeout
+                log.Println("server asked to exit")
+                _ = wire.WriteResponse(stream, nil)
+                stream.Close()
+                exitOnce.Do(func() { close(exit) })
+                tunnelSess.Close()
+            default:
+                handler.Handle(&BufferedConn{Conn: stream, Reader_: reader})
+            }
+        }(tunnelStream)
+    }
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+
+    "lambdaproxy/wire"
+)
+
+var (
+    // HopHeaders only concern the connection to the proxy, Connection
+    // names more of them
+    HopHeaders = []string{"Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Keep-Alive"}
+)
+
+// HeaderFilter cleans the plain http requests the agent passes on, so they
+// don't reveal the proxies they went through. Without a policy only the
+// hop-by-hop headers are removed.
+type HeaderFilter struct {
+    Strip_     []string
+    UserAgent_ string
+}
+
+func NewHeaderFilter(policy *wire.HeaderPolicy) *HeaderFilter {
+    var filter = new(HeaderFilter)
+    if policy != nil {
+        filter.Strip_ = policy.Strip
+        filter.UserAgent_ = policy.UserAgent
+    }
+    return filter
+}
+
+func (self *HeaderFilter) Filter(header http.Header) {
+    upgrade := false
+    for _, v := range header.Values("Connection") {
+        for _, name := range strings.Split(v, ",") {
+            name = strings.TrimSpace(name)
+            if strings.EqualFold(name, "upgrade") {
+                upgrade = true
+                continue
+            }
+            header.Del(name)
+        }
+    }
+    header.Del("Connection")
+    // websockets need both to reach the target
+    if upgrade {
+        header.Set("Connection", "Upgrade")
+    }
+
+    for _, name := range HopHeaders {
+        header.Del(name)
+    }
+    for _, name := range self.Strip_ {
+        header.Del(name)
+    }
+    if self.UserAgent_ != "" {
+        header.Set("User-Agent", self.UserAgent_)
+    }
+}
+
+// Relay passes the requests of a stream the server flagged as plain http to
+// target filtered, the responses as they come. An upgraded connection is
+// piped from then on.
+func (self *HeaderFilter) Relay(stream net.Conn, target net.Conn) {
+    defer target.Close()
+    defer stream.Close()
+
+    done := make(chan struct{})
+    go func() {
+        _, _ = io.Copy(stream, target)
+        stream.Close()
+        close(done)
+    }()
+
+    reader := bufio.NewReader(stream)
+    for {
+        req, err := http.ReadRequest(reader)
+        if err != nil {
+            break
+        }
+        self.Filter(req.Header)
+        // Write would add its own User-Agent
+        if _, ok := req.Header["User-Agent"]; !ok {
+            req.Header["User-Agent"] = []string{""}
+        }
+        err = req.Write(target)
+        if err != nil {
+            break
+        }
+        if req.Header.Get("Upgrade") != "" {
+            _, _ = io.Copy(target, reader)
+            break
+        }
+    }
+    target.Close()
+    <-done
+}
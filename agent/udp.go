@@ -0,0 +1,131 @@
+package agent
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+
+    "lambdaproxy/wire"
+)
+
+// UdpRelay sends the datagrams of one association from a socket of its own
+// and relays back the answers of the targets it sent to.
+type UdpRelay struct {
+    Stream_  net.Conn
+    Reader_  *bufio.Reader
+    Egress_  *Egress
+    Conn_    *net.UDPConn
+    Mutex_   sync.Mutex
+    Targets_ map[string]*net.UDPAddr
+    Peers_   map[string]bool
+}
+
+// ServeUdp answers the udp request on stream and relays until the server
+// closes the stream, which it does once the association is idle.
+func ServeUdp(stream net.Conn, reader *bufio.Reader, egress *Egress) {
+    defer stream.Close()
+
+    req, err := http.ReadRequest(reader)
+    if err != nil {
+        return
+    }
+    req.Body.Close()
+
+    conn, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        _ = wire.WriteError(stream, err)
+        return
+    }
+    defer conn.Close()
+    err = wire.WriteResponse(stream, nil)
+    if err != nil {
+        return
+    }
+
+    var relay = new(UdpRelay)
+    relay.Stream_ = stream
+    relay.Reader_ = reader
+    relay.Egress_ = egress
+    relay.Conn_ = conn
+    relay.Targets_ = make(map[string]*net.UDPAddr)
+    relay.Peers_ = make(map[string]bool)
+
+    go relay.Receive()
+    relay.Send()
+}
+
+// Send writes the datagrams of the stream to their targets. Names are
+// resolved through egress once per association, denied targets dropped.
+func (self *UdpRelay) Send() {
+    for {
+        addr, data, err := wire.ReadDatagram(self.Reader_)
+        if err != nil {
+            return
+        }
+        target, err := self.Target(addr)
+        if err != nil {
+            log.Printf("udp to %s: %v", addr, err)
+            continue
+        }
+        _, err = self.Conn_.WriteToUDP(data, target)
+        if err != nil {
+            log.Printf("udp to %s: %v", addr, err)
+        }
+    }
+}
+
+func (self *UdpRelay) Target(addr string) (*net.UDPAddr, error) {
+    self.Mutex_.Lock()
+    target, ok := self.Targets_[addr]
+    self.Mutex_.Unlock()
+    if ok {
+        if target == nil {
+            return nil, ErrEgressDenied
+        }
+        return target, nil
+    }
+
+    addrs, err := self.Egress_.Resolve(context.Background(), addr)
+    if err == nil {
+        target, err = net.ResolveUDPAddr("udp", addrs[0])
+    }
+
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    if errors.Is(err, ErrEgressDenied) {
+        self.Targets_[addr] = nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    self.Targets_[addr] = target
+    self.Peers_[target.String()] = true
+    return target, nil
+}
+
+// Receive relays the answers back, datagrams from addresses the
+// association never sent to are dropped.
+func (self *UdpRelay) Receive() {
+    buf := make([]byte, wire.MaxDatagramSize)
+    for {
+        n, from, err := self.Conn_.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        self.Mutex_.Lock()
+        known := self.Peers_[from.String()]
+        self.Mutex_.Unlock()
+        if !known {
+            continue
+        }
+        err = wire.WriteDatagram(self.Stream_, from.String(), buf[:n])
+        if err != nil {
+            self.Stream_.Close()
+            return
+        }
+    }
+}
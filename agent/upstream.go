@@ -0,0 +1,68 @@
+package agent
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "net"
+
+    "github.com/ginuerzh/gost"
+)
+
+// NewUpstreamChain builds the chain of http and socks5 proxies, plain or
+// over tls, the agent dials its targets through. nil without any.
+func NewUpstreamChain(urls []string) (*gost.Chain, error) {
+    if len(urls) == 0 {
+        return nil, nil
+    }
+
+    chain := gost.NewChain()
+    chain.Retries = 0
+    for i, v := range urls {
+        node, err := gost.ParseNode(v)
+        if err != nil {
+            return nil, fmt.Errorf("upstream %d: %w", i+1, err)
+        }
+        node.ID = i + 1
+
+        var connector gost.Connector
+        switch node.Protocol {
+        case "http":
+            connector = gost.HTTPConnector(node.User)
+        case "socks5":
+            connector = &NoTLSConnector{Connector: gost.SOCKS5Connector(node.User)}
+        default:
+            return nil, fmt.Errorf("upstream %s: unsupported protocol %q", node.Addr, node.Protocol)
+        }
+
+        var transporter gost.Transporter
+        switch node.Transport {
+        case "tcp":
+            transporter = gost.TCPTransporter()
+        case "tls":
+            transporter = gost.TLSTransporter()
+            host, _, err := net.SplitHostPort(node.Addr)
+            if err != nil {
+                return nil, fmt.Errorf("upstream %s: %w", node.Addr, err)
+            }
+            tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: node.GetBool("insecure")}
+            node.HandshakeOptions = []gost.HandshakeOption{gost.TLSConfigHandshakeOption(tlsConfig)}
+        default:
+            return nil, fmt.Errorf("upstream %s: unsupported transport %q", node.Addr, node.Transport)
+        }
+
+        node.Client = &gost.Client{Connector: connector, Transporter: transporter}
+        chain.AddNode(node)
+    }
+    return chain, nil
+}
+
+// NoTLSConnector keeps the socks5 connector from offering its tls method,
+// which plain socks5 servers don't have.
+type NoTLSConnector struct {
+    gost.Connector
+}
+
+func (self *NoTLSConnector) ConnectContext(ctx context.Context, conn net.Conn, network, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    return self.Connector.ConnectContext(ctx, conn, network, address, append(options, gost.NoTLSConnectOption(true))...)
+}
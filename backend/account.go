@@ -0,0 +1,149 @@
+package backend
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+    _AccountMaxBackoff = 5 * time.Minute
+)
+
+// AccountConfig is one entry of the -accounts file.
+type AccountConfig struct {
+    Name           string   `json:"name"`
+    Profile        string   `json:"profile"`
+    AssumeRole     string   `json:"assume_role"`
+    ExternalId     string   `json:"external_id"`
+    MfaSerial      string   `json:"mfa_serial"`
+    Role           string   `json:"role"`
+    Regions        []string `json:"regions"`
+    MaxConcurrency int64    `json:"max_concurrency"`
+    LambdaEndpoint string   `json:"lambda_endpoint"`
+    IamEndpoint    string   `json:"iam_endpoint"`
+    StsEndpoint    string   `json:"sts_endpoint"`
+}
+
+func (self *AccountConfig) AwsConfig() *AwsConfig {
+    region := ""
+    if len(self.Regions) > 0 {
+        region = self.Regions[0]
+    }
+    return &AwsConfig{
+        Profile_:        self.Profile,
+        Region_:         region,
+        AssumeRoleArn_:  self.AssumeRole,
+        ExternalId_:     self.ExternalId,
+        MfaSerial_:      self.MfaSerial,
+        LambdaEndpoint_: self.LambdaEndpoint,
+        IamEndpoint_:    self.IamEndpoint,
+        StsEndpoint_:    self.StsEndpoint,
+    }
+}
+
+func LoadAccountConfigs(path string) ([]*AccountConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("cannot read accounts file: %w", err)
+    }
+
+    var configs []*AccountConfig
+    err = json.Unmarshal(data, &configs)
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse accounts file %s: %w", path, err)
+    }
+    if len(configs) == 0 {
+        return nil, fmt.Errorf("accounts file %s has no accounts", path)
+    }
+    for i, config := range configs {
+        if config.Name == "" {
+            config.Name = fmt.Sprintf("account%d", i)
+        }
+        if len(config.Regions) == 0 {
+            return nil, fmt.Errorf("account %s has no regions", config.Name)
+        }
+    }
+    return configs, nil
+}
+
+// AwsAccount is one set of credentials with its own regions, concurrency
+// limit and failure state.
+type AwsAccount struct {
+    Name_           string
+    AwsConfig_      *AwsConfig
+    AwsCfg_         aws.Config
+    IamRole_        string
+    RoleArn_        string
+    Regions_        []string
+    MaxConcurrency_ int64
+    Active_         int64
+    InvokeNum_      int64
+    Failures_       int64
+    DisabledUntil_  time.Time
+    SetupMutex_     sync.Mutex
+}
+
+func NewAwsAccount(ctx context.Context, config *AccountConfig, create_role bool, role_policy string) (*AwsAccount, error) {
+    awsConfig := config.AwsConfig()
+    cfg, err := awsConfig.Load(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("account %s: %v", config.Name, err)
+    }
+
+    roleArn, err := GetOrCreateRole(ctx, awsConfig.IamClient(cfg), config.Role, create_role, role_policy)
+    if err != nil {
+        return nil, fmt.Errorf("account %s: %v", config.Name, err)
+    }
+
+    var account = new(AwsAccount)
+    account.Name_ = config.Name
+    account.AwsConfig_ = awsConfig
+    account.AwsCfg_ = cfg
+    account.IamRole_ = config.Role
+    account.RoleArn_ = roleArn
+    account.Regions_ = config.Regions
+    account.MaxConcurrency_ = config.MaxConcurrency
+
+    return account, nil
+}
+
+// Available reports whether the account can take another invocation. The
+// caller holds AwsLambda.Mutex_.
+func (self *AwsAccount) Available(now time.Time) bool {
+    if now.Before(self.DisabledUntil_) {
+        return false
+    }
+    return self.MaxConcurrency_ <= 0 || self.Active_ < self.MaxConcurrency_
+}
+
+// NextRegion rotates over the account regions. The caller holds
+// AwsLambda.Mutex_.
+func (self *AwsAccount) NextRegion() string {
+    region := self.Regions_[self.InvokeNum_%int64(len(self.Regions_))]
+    self.InvokeNum_++
+    return region
+}
+
+// MarkFailure backs the account off exponentially. The caller holds
+// AwsLambda.Mutex_.
+func (self *AwsAccount) MarkFailure(err error) {
+    self.Failures_++
+    backoff := time.Second << uint(self.Failures_)
+    if self.Failures_ > 16 || backoff > _AccountMaxBackoff {
+        backoff = _AccountMaxBackoff
+    }
+    self.DisabledUntil_ = time.Now().Add(backoff)
+    log.Printf("account %s failed %d times, backing off %v: %v", self.Name_, self.Failures_, backoff, err)
+}
+
+func (self *AwsAccount) MarkSuccess() {
+    self.Failures_ = 0
+    self.DisabledUntil_ = time.Time{}
+}
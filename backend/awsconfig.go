@@ -0,0 +1,93 @@
+package backend
+
+import (
+    "context"
+    "fmt"
+    "log"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/config"
+    "github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+    "github.com/aws/aws-sdk-go-v2/service/iam"
+    "github.com/aws/aws-sdk-go-v2/service/lambda"
+    "github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+    _AwsDefaultRegion = "us-east-1"
+)
+
+// AwsConfig selects the credentials and endpoints used to talk to aws. The
+// zero value uses the default credential chain against real aws endpoints.
+type AwsConfig struct {
+    Profile_        string
+    Region_         string
+    AssumeRoleArn_  string
+    ExternalId_     string
+    MfaSerial_      string
+    LambdaEndpoint_ string
+    IamEndpoint_    string
+    StsEndpoint_    string
+}
+
+func (self *AwsConfig) Region() string {
+    if self.Region_ == "" {
+        return _AwsDefaultRegion
+    }
+    return self.Region_
+}
+
+func (self *AwsConfig) Load(ctx context.Context) (aws.Config, error) {
+    cfg, err := config.LoadDefaultConfig(ctx,
+        config.WithRegion(self.Region()),
+        config.WithSharedConfigProfile(self.Profile_),
+        config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+            o.TokenProvider = stscreds.StdinTokenProvider
+        }),
+    )
+    if err != nil {
+        return aws.Config{}, fmt.Errorf("config.LoadDefaultConfig err %v", err)
+    }
+
+    if self.AssumeRoleArn_ != "" {
+        log.Printf("Assuming role %s", self.AssumeRoleArn_)
+        stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+            if self.StsEndpoint_ != "" {
+                o.BaseEndpoint = aws.String(self.StsEndpoint_)
+            }
+        })
+        provider := stscreds.NewAssumeRoleProvider(stsClient, self.AssumeRoleArn_, func(o *stscreds.AssumeRoleOptions) {
+            o.RoleSessionName = "lambdaproxy"
+            if self.ExternalId_ != "" {
+                o.ExternalID = aws.String(self.ExternalId_)
+            }
+            if self.MfaSerial_ != "" {
+                o.SerialNumber = aws.String(self.MfaSerial_)
+                o.TokenProvider = stscreds.StdinTokenProvider
+            }
+        })
+        cfg.Credentials = aws.NewCredentialsCache(provider)
+    }
+
+    if _, err = cfg.Credentials.Retrieve(ctx); err != nil {
+        return aws.Config{}, fmt.Errorf("cfg.Credentials.Retrieve() err %v", err)
+    }
+    return cfg, nil
+}
+
+func (self *AwsConfig) LambdaClient(cfg aws.Config, region string) *lambda.Client {
+    return lambda.NewFromConfig(cfg, func(o *lambda.Options) {
+        o.Region = region
+        if self.LambdaEndpoint_ != "" {
+            o.BaseEndpoint = aws.String(self.LambdaEndpoint_)
+        }
+    })
+}
+
+func (self *AwsConfig) IamClient(cfg aws.Config) *iam.Client {
+    return iam.NewFromConfig(cfg, func(o *iam.Options) {
+        if self.IamEndpoint_ != "" {
+            o.BaseEndpoint = aws.String(self.IamEndpoint_)
+        }
+    })
+}
@@ -0,0 +1,204 @@
+package backend
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/iam"
+    "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+const (
+    _RolePolicyBasic            = "basic"
+    _RolePolicyNone             = "none"
+    _LambdaBasicExecutionPolicy = "arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
+    _LambdaTrustPolicy          = `{
+    "Version": "2012-10-17",
+    "Statement": [{
+        "Effect": "Allow",
+        "Principal": {"Service": "lambda.amazonaws.com"},
+        "Action": "sts:AssumeRole"
+    }]
+}`
+
+    // IAM gives no signal for when a new role becomes assumable by Lambda,
+    // so after the role is consistently visible we still wait this long.
+    _IamPropagationDelay  = 10 * time.Second
+    _IamConsistentReads   = 3
+    _IamPropagationChecks = 30
+    _IamRoleExistsTimeout = 2 * time.Minute
+)
+
+type IamStatement struct {
+    Effect    string                       `json:"Effect"`
+    Action    []string                     `json:"Action"`
+    Resource  []string                     `json:"Resource"`
+    Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+type IamPolicy struct {
+    Version   string          `json:"Version"`
+    Statement []*IamStatement `json:"Statement"`
+}
+
+// RequiredIamPolicy returns the least-privilege policy the server's own
+// credentials need to deploy and invoke the function.
+func RequiredIamPolicy(lambdaName string, roleName string, createRole bool, rolePolicy string) *IamPolicy {
+    functionArn := fmt.Sprintf("arn:aws:lambda:*:*:function:%s", lambdaName)
+    roleArn := fmt.Sprintf("arn:aws:iam::*:role/%s", roleName)
+
+    roleActions := []string{"iam:GetRole"}
+    if createRole {
+        roleActions = append(roleActions, "iam:CreateRole", "iam:ListAttachedRolePolicies")
+        if rolePolicy == _RolePolicyBasic {
+            roleActions = append(roleActions, "iam:AttachRolePolicy")
+        }
+    }
+
+    return &IamPolicy{
+        Version: "2012-10-17",
+        Statement: []*IamStatement{
+            {
+                Effect: "Allow",
+                Action: []string{
+                    "lambda:GetFunction",
+                    "lambda:CreateFunction",
+                    "lambda:DeleteFunction",
+                    "lambda:InvokeFunction",
+                },
+                Resource: []string{functionArn},
+            },
+            {
+                Effect:   "Allow",
+                Action:   roleActions,
+                Resource: []string{roleArn},
+            },
+            {
+                Effect:   "Allow",
+                Action:   []string{"iam:PassRole"},
+                Resource: []string{roleArn},
+                Condition: map[string]map[string]string{
+                    "StringEquals": {"iam:PassedToService": "lambda.amazonaws.com"},
+                },
+            },
+        },
+    }
+}
+
+func PrintRequiredIamPolicy(w io.Writer, lambdaName string, roleName string, createRole bool, rolePolicy string) error {
+    data, err := json.MarshalIndent(RequiredIamPolicy(lambdaName, roleName, createRole, rolePolicy), "", "    ")
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(w, "%s\n", data)
+    return err
+}
+
+// GetOrCreateRole returns the arn of the role, creating it with the Lambda
+// trust policy when it does not exist and createRole is set.
+func GetOrCreateRole(ctx context.Context, awsIAM *iam.Client, roleName string, createRole bool, rolePolicy string) (string, error) {
+    if rolePolicy != _RolePolicyBasic && rolePolicy != _RolePolicyNone {
+        return "", fmt.Errorf("unknown role policy %q, expected %s or %s", rolePolicy, _RolePolicyBasic, _RolePolicyNone)
+    }
+
+    roleInfo, err := awsIAM.GetRole(ctx, &iam.GetRoleInput{
+        RoleName: aws.String(roleName),
+    })
+    if err == nil {
+        return *roleInfo.Role.Arn, nil
+    }
+    var notFound *types.NoSuchEntityException
+    if !errors.As(err, &notFound) {
+        return "", fmt.Errorf("Could not get IAM role %s: %v", roleName, err)
+    }
+    if !createRole {
+        return "", fmt.Errorf("Could not find IAM role %s, create it or pass -create-role", roleName)
+    }
+
+    log.Printf("Creating IAM role %s with policy=%s", roleName, rolePolicy)
+    created, err := awsIAM.CreateRole(ctx, &iam.CreateRoleInput{
+        RoleName:                 aws.String(roleName),
+        AssumeRolePolicyDocument: aws.String(_LambdaTrustPolicy),
+        Description:              aws.String("lambdaproxy function execution role"),
+    })
+    if err != nil {
+        return "", fmt.Errorf("Could not create IAM role %s: %v", roleName, err)
+    }
+
+    if rolePolicy == _RolePolicyBasic {
+        _, err = awsIAM.AttachRolePolicy(ctx, &iam.AttachRolePolicyInput{
+            RoleName:  aws.String(roleName),
+            PolicyArn: aws.String(_LambdaBasicExecutionPolicy),
+        })
+        if err != nil {
+            return "", fmt.Errorf("Could not attach %s to IAM role %s: %v", _LambdaBasicExecutionPolicy, roleName, err)
+        }
+    }
+
+    err = WaitRolePropagation(ctx, awsIAM, roleName, rolePolicy)
+    if err != nil {
+        return "", err
+    }
+
+    return *created.Role.Arn, nil
+}
+
+// WaitRolePropagation blocks until the role and its policy attachment are
+// consistently readable, then gives Lambda time to see the trust policy.
+func WaitRolePropagation(ctx context.Context, awsIAM *iam.Client, roleName string, rolePolicy string) error {
+    err := iam.NewRoleExistsWaiter(awsIAM).Wait(ctx, &iam.GetRoleInput{
+        RoleName: aws.String(roleName),
+    }, _IamRoleExistsTimeout)
+    if err != nil {
+        return fmt.Errorf("IAM role %s did not become visible: %v", roleName, err)
+    }
+
+    consistent := 0
+    for i := 0; i < _IamPropagationChecks && consistent < _IamConsistentReads; i++ {
+        if ready, err := RoleReady(ctx, awsIAM, roleName, rolePolicy); err == nil && ready {
+            consistent++
+        } else {
+            consistent = 0
+        }
+        if err := SleepContext(ctx, time.Second); err != nil {
+            return err
+        }
+    }
+    if consistent < _IamConsistentReads {
+        return fmt.Errorf("IAM role %s did not propagate", roleName)
+    }
+
+    log.Printf("Waiting %v for IAM role %s to propagate to Lambda", _IamPropagationDelay, roleName)
+    return SleepContext(ctx, _IamPropagationDelay)
+}
+
+func RoleReady(ctx context.Context, awsIAM *iam.Client, roleName string, rolePolicy string) (bool, error) {
+    _, err := awsIAM.GetRole(ctx, &iam.GetRoleInput{
+        RoleName: aws.String(roleName),
+    })
+    if err != nil {
+        return false, err
+    }
+    if rolePolicy != _RolePolicyBasic {
+        return true, nil
+    }
+
+    attached, err := awsIAM.ListAttachedRolePolicies(ctx, &iam.ListAttachedRolePoliciesInput{
+        RoleName: aws.String(roleName),
+    })
+    if err != nil {
+        return false, err
+    }
+    for _, policy := range attached.AttachedPolicies {
+        if aws.ToString(policy.PolicyArn) == _LambdaBasicExecutionPolicy {
+            return true, nil
+        }
+    }
+    return false, nil
+}
@@ -0,0 +1,310 @@
+// Package backend deploys the agent as a lambda function over one or more
+// aws accounts and regions and invokes it.
+package backend
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/aws/aws-sdk-go-v2/aws"
+    "github.com/aws/aws-sdk-go-v2/service/lambda"
+    "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+const (
+    _LambdaHandler      = "main"
+    _LambdaRuntime      = types.RuntimeGo1x
+    _LambdaCreateRetrys = 10
+)
+
+// AwsLambda deploys AgentZip_ as the function in every account and region
+// and invokes it. Without a zip the functions already deployed are used.
+type AwsLambda struct {
+    Accounts_         []*AwsAccount
+    Name_             string
+    AgentZip_         []byte
+    InvokeNum_        int64
+    LambdaTimeout_    int64
+    LambdaMemorySize_ int64
+    Mutex_            sync.RWMutex
+}
+
+func NewAwsLambda(ctx context.Context, accounts []*AccountConfig, name string, agentZip []byte, labmda_timeout int64, lambda_mem_size int64, create_role bool, role_policy string) (*AwsLambda, error) {
+    var awsLambda = new(AwsLambda)
+    awsLambda.Name_ = name
+    awsLambda.AgentZip_ = agentZip
+    awsLambda.InvokeNum_ = 0
+    awsLambda.LambdaTimeout_ = labmda_timeout
+    awsLambda.LambdaMemorySize_ = lambda_mem_size
+
+    for _, config := range accounts {
+        account, err := NewAwsAccount(ctx, config, create_role, role_policy)
+        if err != nil {
+            return nil, err
+        }
+        awsLambda.Accounts_ = append(awsLambda.Accounts_, account)
+    }
+
+    err := awsLambda.Setup(ctx)
+    if errors.Is(err, context.Canceled) {
+        return nil, err
+    }
+
+    return awsLambda, nil
+}
+
+func (self *AwsLambda) Setup(ctx context.Context) error {
+    if self.AgentZip_ == nil {
+        return errors.New("no agent zip to deploy")
+    }
+
+    for _, account := range self.Accounts_ {
+        for _, region := range account.Regions_ {
+            err := self.DoSetup(ctx, account, region, self.AgentZip_)
+            if err != nil {
+                return fmt.Errorf("Could not setup Lambda function in account %s region %s: %w", account.Name_, region, err)
+            }
+        }
+    }
+    return nil
+}
+
+// LambdaTarget is the account and region one invocation runs in.
+type LambdaTarget struct {
+    Account_ *AwsAccount
+    Region_  string
+}
+
+// PickAccount returns the available account with the fewest running
+// invocations, rotating between equally loaded ones, and reserves a slot on it.
+func (self *AwsLambda) PickAccount() *LambdaTarget {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    now := time.Now()
+    var picked *AwsAccount
+    for i := range self.Accounts_ {
+        account := self.Accounts_[(self.InvokeNum_+int64(i))%int64(len(self.Accounts_))]
+        if !account.Available(now) {
+            continue
+        }
+        if picked == nil || account.Active_ < picked.Active_ {
+            picked = account
+        }
+    }
+    if picked == nil {
+        return nil
+    }
+
+    self.InvokeNum_++
+    picked.Active_++
+    return &LambdaTarget{Account_: picked, Region_: picked.NextRegion()}
+}
+
+func (self *AwsLambda) Release(target *LambdaTarget, err error) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    account := target.Account_
+    account.Active_--
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    if err != nil {
+        account.MarkFailure(err)
+    } else {
+        account.MarkSuccess()
+    }
+}
+
+// Acquire waits for an account with spare concurrency. The slot is given
+// back by Invoke.
+func (self *AwsLambda) Acquire(ctx context.Context) (*LambdaTarget, error) {
+    target := self.PickAccount()
+    for target == nil {
+        log.Printf("no aws account available, waiting...")
+        if err := SleepContext(ctx, time.Second); err != nil {
+            return nil, err
+        }
+        target = self.PickAccount()
+    }
+    return target, nil
+}
+
+// Regions lists every region some account deploys to.
+func (self *AwsLambda) Regions() []string {
+    var regions []string
+    seen := map[string]bool{}
+    for _, account := range self.Accounts_ {
+        for _, region := range account.Regions_ {
+            if !seen[region] {
+                seen[region] = true
+                regions = append(regions, region)
+            }
+        }
+    }
+    return regions
+}
+
+func (self *AwsLambda) Invoke(ctx context.Context, target *LambdaTarget, payload []byte) error {
+    err := self.DoInvoke(ctx, target.Account_, target.Region_, payload)
+    self.Release(target, err)
+    if err != nil {
+        return fmt.Errorf("account %s region %s: %v", target.Account_.Name_, target.Region_, err)
+    }
+    return nil
+}
+
+func (self *AwsLambda) DoInvoke(ctx context.Context, account *AwsAccount, region string, payload []byte) error {
+    account.SetupMutex_.Lock()
+    if self.AgentZip_ != nil {
+        err := self.DoSetup(ctx, account, region, self.AgentZip_)
+        if err != nil {
+            account.SetupMutex_.Unlock()
+            return err
+        }
+    }
+    lamdaHandler := account.AwsConfig_.LambdaClient(account.AwsCfg_, region)
+    log.Printf("Waiting lambda ready")
+    err := SleepContext(ctx, 10*time.Second)
+    account.SetupMutex_.Unlock()
+    if err != nil {
+        return err
+    }
+
+    out, err := lamdaHandler.Invoke(ctx, &lambda.InvokeInput{
+        FunctionName: aws.String(self.Name_),
+        Payload:      payload,
+    })
+    if err != nil {
+        return err
+    }
+    if out.FunctionError != nil {
+        return fmt.Errorf("agent %s: %s", *out.FunctionError, out.Payload)
+    }
+    return nil
+}
+
+// Redeploy replaces the function in the target region, for an agent that
+// failed the handshake as outdated.
+func (self *AwsLambda) Redeploy(ctx context.Context, target *LambdaTarget) error {
+    if self.AgentZip_ == nil {
+        return errors.New("no agent zip to deploy")
+    }
+
+    account := target.Account_
+    account.SetupMutex_.Lock()
+    defer account.SetupMutex_.Unlock()
+    log.Printf("Redeploying outdated agent in account=%s, region=%s.", account.Name_, target.Region_)
+    return self.DoSetup(ctx, account, target.Region_, self.AgentZip_)
+}
+
+// Cleanup deletes the function from every account and region.
+func (self *AwsLambda) Cleanup(ctx context.Context) error {
+    var errs []error
+    for _, account := range self.Accounts_ {
+        for _, region := range account.Regions_ {
+            log.Printf("Deleting Lambda function name=%s, account=%s, region=%s.", self.Name_, account.Name_, region)
+            err := self.Delete(ctx, account.AwsConfig_.LambdaClient(account.AwsCfg_, region))
+            var notFound *types.ResourceNotFoundException
+            if err != nil && !errors.As(err, &notFound) {
+                errs = append(errs, fmt.Errorf("account %s region %s: %w", account.Name_, region, err))
+            }
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (self *AwsLambda) DoSetup(ctx context.Context, account *AwsAccount, region string, lambdaZipData []byte) error {
+    lamdaHandler := account.AwsConfig_.LambdaClient(account.AwsCfg_, region)
+    log.Printf("Setting up Lambda function in name=%s, account=%s, region=%s, invoke_num=%d.", self.Name_, account.Name_, region, account.InvokeNum_)
+    exists, err := self.Exists(ctx, lamdaHandler, self.Name_)
+    if err != nil {
+        return err
+    }
+
+    if exists {
+        err := self.Delete(ctx, lamdaHandler)
+        if err != nil {
+            return err
+        }
+    }
+
+    return self.Create(ctx, lamdaHandler, account.RoleArn_, lambdaZipData)
+}
+
+func (self *AwsLambda) Delete(ctx context.Context, lamdaHandler *lambda.Client) error {
+    _, err := lamdaHandler.DeleteFunction(ctx, &lambda.DeleteFunctionInput{
+        FunctionName: aws.String(self.Name_),
+    })
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+func (self *AwsLambda) Create(ctx context.Context, lamdaHandler *lambda.Client, roleArn string, payload []byte) error {
+    return self.DoCreate(ctx, lamdaHandler, roleArn, payload, _LambdaCreateRetrys)
+}
+
+// DoCreate retries a few times on InvalidParameterValueException, which lambda
+// also returns while a freshly deleted function of the same name goes away.
+func (self *AwsLambda) DoCreate(ctx context.Context, lamdaHandler *lambda.Client, roleArn string, payload []byte, retrys int) error {
+    _, err := lamdaHandler.CreateFunction(ctx, &lambda.CreateFunctionInput{
+        Code: &types.FunctionCode{
+            ZipFile: payload,
+        },
+        FunctionName: aws.String(self.Name_),
+        Handler:      aws.String(_LambdaHandler),
+        Role:         aws.String(roleArn),
+        Runtime:      _LambdaRuntime,
+        MemorySize:   aws.Int32(int32(self.LambdaMemorySize_)),
+        Publish:      true,
+        Timeout:      aws.Int32(int32(self.LambdaTimeout_)),
+    })
+    if err != nil {
+        var invalid *types.InvalidParameterValueException
+        if errors.As(err, &invalid) && retrys > 0 {
+            log.Printf("CreateFunction name=%s not ready: %s", self.Name_, invalid.ErrorMessage())
+            if err := SleepContext(ctx, time.Second); err != nil {
+                return err
+            }
+            return self.DoCreate(ctx, lamdaHandler, roleArn, payload, retrys-1)
+        }
+        return err
+    }
+    return nil
+}
+
+func (self *AwsLambda) Exists(ctx context.Context, lamdaHandler *lambda.Client, name string) (bool, error) {
+    _, err := lamdaHandler.GetFunction(ctx, &lambda.GetFunctionInput{
+        FunctionName: aws.String(name),
+    })
+
+    if err != nil {
+        var notFound *types.ResourceNotFoundException
+        if errors.As(err, &notFound) {
+            return false, nil
+        }
+        return false, err
+    }
+
+    return true, nil
+}
+
+// SleepContext sleeps for d or until ctx is done, whichever comes first.
+func SleepContext(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-timer.C:
+        return nil
+    }
+}
@@ -1,13 +1,75 @@
 module lambdaproxy
 
-go 1.12
+go 1.24
 
 require (
-	git.torproject.org/pluggable-transports/goptlib.git v1.0.0 // indirect
 	github.com/aws/aws-lambda-go v1.26.0
-	github.com/aws/aws-sdk-go v1.40.49
+	github.com/aws/aws-sdk-go-v2 v1.47.1
+	github.com/aws/aws-sdk-go-v2/config v1.33.6
+	github.com/aws/aws-sdk-go-v2/credentials v1.20.6
+	github.com/aws/aws-sdk-go-v2/service/iam v1.64.1
+	github.com/aws/aws-sdk-go-v2/service/lambda v1.110.0
+	github.com/aws/aws-sdk-go-v2/service/sts v1.51.1
 	github.com/elazarl/goproxy v0.0.0-20210801061803-8e322dfb79c4
+	github.com/ginuerzh/gosocks5 v0.2.0
 	github.com/ginuerzh/gost v0.0.0-20200414134316-6e46ac03c7a7
 	github.com/hashicorp/yamux v0.0.0-20210826001029-26ff87cf9493
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
+
+require (
+	git.torproject.org/pluggable-transports/goptlib.git v1.0.0 // indirect
+	git.torproject.org/pluggable-transports/obfs4.git v0.0.0-20181103133120-08f4d470188e // indirect
+	github.com/LiamHaworth/go-tproxy v0.0.0-20190726054950-ef7efd7f24ed // indirect
+	github.com/Yawning/chacha20 v0.0.0-20170904085104-e3b1f968fc63 // indirect
+	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
+	github.com/agl/ed25519 v0.0.0-20170116200512-5312a6153412 // indirect
+	github.com/asaskevich/govalidator v0.0.0-20200108200545-475eaeb16496 // indirect
+	github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream v1.7.20 // indirect
+	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.20.1 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.5.4 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.8.4 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/v4a v1.5.4 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.13.19 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.14.4 // indirect
+	github.com/aws/aws-sdk-go-v2/service/signin v1.10.1 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sso v1.38.1 // indirect
+	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.43.1 // indirect
+	github.com/aws/smithy-go v1.28.2 // indirect
+	github.com/bifurcation/mint v0.0.0-20181105071958-a14404e9a861 // indirect
+	github.com/cheekybits/genny v1.0.0 // indirect
+	github.com/coreos/go-iptables v0.4.5 // indirect
+	github.com/dchest/siphash v1.2.1 // indirect
+	github.com/docker/libcontainer v2.2.1+incompatible // indirect
+	github.com/ginuerzh/gosocks4 v0.0.1 // indirect
+	github.com/ginuerzh/tls-dissector v0.0.2-0.20200224064855-24ab2b3a3796 // indirect
+	github.com/go-gost/relay v0.1.0 // indirect
+	github.com/go-log/log v0.1.0 // indirect
+	github.com/gobwas/glob v0.2.3 // indirect
+	github.com/google/gopacket v1.1.17 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/klauspost/compress v1.4.1 // indirect
+	github.com/klauspost/cpuid v1.2.0 // indirect
+	github.com/klauspost/reedsolomon v1.7.0 // indirect
+	github.com/lucas-clemente/aes12 v0.0.0-20171027163421-cd47fb39b79f // indirect
+	github.com/lucas-clemente/quic-go v0.10.0 // indirect
+	github.com/lucas-clemente/quic-go-certificates v0.0.0-20160823095156-d2f86524cced // indirect
+	github.com/miekg/dns v1.1.27 // indirect
+	github.com/milosgajdos83/tenus v0.0.0-20190415114537-1f3ed00ae7d8 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/ryanuber/go-glob v0.0.0-20170128012129-256dc444b735 // indirect
+	github.com/shadowsocks/go-shadowsocks2 v0.1.0 // indirect
+	github.com/shadowsocks/shadowsocks-go v0.0.0-20170121203516-97a5c71f80ba // indirect
+	github.com/songgao/water v0.0.0-20190725173103-fd331bda3f4b // indirect
+	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
+	github.com/templexxx/xor v0.0.0-20181023030647-4e92f724b73b // indirect
+	github.com/tjfoc/gmsm v1.0.1 // indirect
+	github.com/xtaci/tcpraw v1.2.25 // indirect
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	golang.org/x/text v0.3.6 // indirect
+	gopkg.in/gorilla/websocket.v1 v1.4.0 // indirect
+	gopkg.in/xtaci/kcp-go.v4 v4.3.2 // indirect
+	gopkg.in/xtaci/smux.v1 v1.0.7 // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
+)
@@ -0,0 +1,468 @@
+package integration
+
+import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/json"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "lambdaproxy/agent"
+    "lambdaproxy/backend"
+    "lambdaproxy/proxy"
+    "lambdaproxy/tunnel"
+    "lambdaproxy/wire"
+)
+
+const (
+    _ExitIP = "203.0.113.7"
+)
+
+// SSHServer is an in-process ssh server doing only what the agents need:
+// public key logins against an authorized keys file and direct-tcpip
+// forwarding to the tunnel listeners.
+type SSHServer struct {
+    Listener_ net.Listener
+    AuthFile_ string
+    Config_   *ssh.ServerConfig
+    Mutex_    sync.Mutex
+    Conns_    map[string][]net.Conn
+}
+
+func NewSSHServer(t *testing.T, authFile string) *SSHServer {
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(private)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var server = new(SSHServer)
+    server.Listener_ = ln
+    server.AuthFile_ = authFile
+    server.Conns_ = make(map[string][]net.Conn)
+    server.Config_ = &ssh.ServerConfig{PublicKeyCallback: server.Authorize}
+    server.Config_.AddHostKey(signer)
+
+    go server.Serve()
+    t.Cleanup(func() { ln.Close() })
+    return server
+}
+
+// Authorize reads the file on every login, so a revoked key is refused.
+func (self *SSHServer) Authorize(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    rest, err := os.ReadFile(self.AuthFile_)
+    if err != nil {
+        return nil, err
+    }
+    for len(rest) > 0 {
+        var authorized ssh.PublicKey
+        authorized, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+        if err != nil {
+            break
+        }
+        if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+            return nil, nil
+        }
+    }
+    return nil, errors.New("unknown key")
+}
+
+func (self *SSHServer) Addr() string {
+    return self.Listener_.Addr().String()
+}
+
+func (self *SSHServer) Serve() {
+    for {
+        conn, err := self.Listener_.Accept()
+        if err != nil {
+            return
+        }
+        go self.Handle(conn)
+    }
+}
+
+func (self *SSHServer) Handle(conn net.Conn) {
+    sshConn, channels, requests, err := ssh.NewServerConn(conn, self.Config_)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    defer sshConn.Close()
+    go ssh.DiscardRequests(requests)
+
+    for newChannel := range channels {
+        if newChannel.ChannelType() != "direct-tcpip" {
+            newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+            continue
+        }
+        var forward struct {
+            Host     string
+            Port     uint32
+            OrigHost string
+            OrigPort uint32
+        }
+        err := ssh.Unmarshal(newChannel.ExtraData(), &forward)
+        if err != nil {
+            newChannel.Reject(ssh.ConnectionFailed, err.Error())
+            continue
+        }
+        target := net.JoinHostPort(forward.Host, strconv.Itoa(int(forward.Port)))
+        go self.Forward(conn, newChannel, target)
+    }
+}
+
+// Forward connects a channel to target. The connections are kept by
+// target so a test can cut the tunnel of one agent.
+func (self *SSHServer) Forward(sshConn net.Conn, newChannel ssh.NewChannel, target string) {
+    targetConn, err := net.Dial("tcp", target)
+    if err != nil {
+        newChannel.Reject(ssh.ConnectionFailed, err.Error())
+        return
+    }
+    channel, requests, err := newChannel.Accept()
+    if err != nil {
+        targetConn.Close()
+        return
+    }
+    go ssh.DiscardRequests(requests)
+
+    self.Mutex_.Lock()
+    self.Conns_[targetConn.LocalAddr().String()] = []net.Conn{sshConn, targetConn}
+    self.Mutex_.Unlock()
+
+    go func() {
+        io.Copy(targetConn, channel)
+        targetConn.Close()
+    }()
+    io.Copy(channel, targetConn)
+    channel.Close()
+}
+
+// Cut closes the forwarded connection that arrived at the tunnel from
+// remote, either with the agent's ssh connection or alone.
+func (self *SSHServer) Cut(remote string, killAgent bool) bool {
+    self.Mutex_.Lock()
+    conns, ok := self.Conns_[remote]
+    self.Mutex_.Unlock()
+    if !ok {
+        return false
+    }
+    if killAgent {
+        conns[0].Close()
+    }
+    conns[1].Close()
+    return true
+}
+
+// FakeBackend invokes the agent in a goroutine the way lambda runs it, the
+// invocation lasts until the agent returns or Timeout_ cuts it.
+type FakeBackend struct {
+    Account_     *backend.AwsAccount
+    Timeout_     time.Duration
+    Invocations_ int64
+    Failures_    int64
+    Redeploys_   int64
+}
+
+func NewFakeBackend(regions []string, timeout time.Duration) *FakeBackend {
+    return &FakeBackend{
+        Account_: &backend.AwsAccount{Name_: "fake", Regions_: regions},
+        Timeout_: timeout,
+    }
+}
+
+func (self *FakeBackend) Acquire(ctx context.Context) (*backend.LambdaTarget, error) {
+    n := atomic.LoadInt64(&self.Invocations_)
+    return &backend.LambdaTarget{Account_: self.Account_, Region_: self.Account_.Regions_[n%int64(len(self.Account_.Regions_))]}, nil
+}
+
+func (self *FakeBackend) Release(target *backend.LambdaTarget, err error) {
+    if err != nil {
+        atomic.AddInt64(&self.Failures_, 1)
+    }
+}
+
+func (self *FakeBackend) Invoke(ctx context.Context, target *backend.LambdaTarget, payload []byte) error {
+    atomic.AddInt64(&self.Invocations_, 1)
+    var req wire.Request
+    err := json.Unmarshal(payload, &req)
+    if err != nil {
+        self.Release(target, err)
+        return err
+    }
+
+    done := make(chan error, 1)
+    go func() {
+        done <- agent.HandleRequest(req)
+    }()
+
+    select {
+    case err = <-done:
+    case <-time.After(self.Timeout_):
+        err = errors.New("lambda timeout")
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+    self.Release(target, err)
+    return err
+}
+
+func (self *FakeBackend) Redeploy(ctx context.Context, target *backend.LambdaTarget) error {
+    atomic.AddInt64(&self.Redeploys_, 1)
+    return nil
+}
+
+func (self *FakeBackend) Regions() []string {
+    return self.Account_.Regions_
+}
+
+// Harness runs the server side against fake lambdas and a local origin.
+type Harness struct {
+    SSH_     *SSHServer
+    Backend_ *FakeBackend
+    Tunnel_  *tunnel.Tunnel
+    Proxyer_ *proxy.Proxyer
+    Origin_  *httptest.Server
+    Cancel_  context.CancelFunc
+}
+
+type HarnessConfig struct {
+    Regions      []string
+    TunnelSize   int64
+    ConnTimeoutS int64
+    Timeout      time.Duration
+    AgentMode    string
+    Forward      string
+    ExitIP       func(origin string) string
+    Listeners    func(origin string) []string
+    Egress       func(origin string) *wire.EgressPolicy
+    Headers      *wire.HeaderPolicy
+    Upstream     []string
+    DirectUdp    bool
+    AccessLog    string
+}
+
+func NewHarness(t *testing.T, config HarnessConfig) *Harness {
+    if len(config.Regions) == 0 {
+        config.Regions = []string{"test-1"}
+    }
+    if config.TunnelSize == 0 {
+        config.TunnelSize = 1
+    }
+    if config.ConnTimeoutS == 0 {
+        config.ConnTimeoutS = 60
+    }
+    if config.Timeout == 0 {
+        config.Timeout = time.Minute
+    }
+    if config.AgentMode == "" {
+        config.AgentMode = wire.ModeHttp
+    }
+
+    var h = new(Harness)
+    h.Origin_ = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/ip":
+            io.WriteString(w, _ExitIP+"\n")
+            return
+        case "/slow":
+            select {
+            case <-time.After(5 * time.Second):
+            case <-r.Context().Done():
+            }
+        }
+        io.WriteString(w, "hello "+r.URL.Path)
+    }))
+    t.Cleanup(h.Origin_.Close)
+
+    authFile := filepath.Join(t.TempDir(), "authorized_keys")
+    key, err := tunnel.NewSSHKey(authFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.SSH_ = NewSSHServer(t, authFile)
+    h.Backend_ = NewFakeBackend(config.Regions, config.Timeout)
+
+    h.Tunnel_ = tunnel.NewTunnelSSH(h.Backend_, config.TunnelSize, config.ConnTimeoutS, h.SSH_.Addr(), "lambda", key)
+    exitIP := h.Origin_.URL + "/ip"
+    if config.ExitIP != nil {
+        exitIP = config.ExitIP(h.Origin_.URL)
+    }
+    discoverer, err := tunnel.ParseIPDiscoverer(exitIP)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.Tunnel_.SetExitIPDiscoverer(discoverer)
+
+    forward := config.Forward
+    if forward == "origin" {
+        forward = h.Origin_.Listener.Addr().String()
+    }
+    err = h.Tunnel_.SetAgentMode(config.AgentMode, forward)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.Egress != nil {
+        h.Tunnel_.SetEgressPolicy(config.Egress(h.Origin_.Listener.Addr().String()))
+    }
+    h.Tunnel_.SetHeaderPolicy(config.Headers)
+    h.Tunnel_.SetUpstream(config.Upstream, config.DirectUdp)
+
+    usage, err := proxy.NewUsageDB("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    listeners := []string{"http://127.0.0.1:0", "socks5://127.0.0.1:0"}
+    if config.Listeners != nil {
+        listeners = append(listeners, config.Listeners(h.Origin_.Listener.Addr().String())...)
+    }
+    var accessLog *proxy.AccessLog
+    if config.AccessLog != "" {
+        accessLog, err = proxy.NewAccessLog(config.AccessLog, 0, 0, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { accessLog.Close() })
+    }
+    h.Proxyer_, err = proxy.NewProxyer(listeners, h.Tunnel_, nil, usage, accessLog, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    h.Cancel_ = cancel
+    go h.Tunnel_.Run(ctx)
+
+    t.Cleanup(func() {
+        cancel()
+        h.Proxyer_.Shutdown(time.Second)
+        _ = h.Tunnel_.Shutdown(time.Second)
+    })
+    return h
+}
+
+func (self *Harness) ProxyUrl(protocol string) *url.URL {
+    for _, listener := range self.Proxyer_.Listeners_ {
+        if listener.Node_.Protocol == protocol {
+            return &url.URL{Scheme: protocol, Host: listener.Server_.Addr().String()}
+        }
+    }
+    return nil
+}
+
+// ListenerProxyUrl finds the listener started from listenerUrl.
+func (self *Harness) ListenerProxyUrl(listenerUrl string) *url.URL {
+    for _, listener := range self.Proxyer_.Listeners_ {
+        if listener.Url_ == listenerUrl {
+            return &url.URL{Scheme: "http", Host: listener.Server_.Addr().String()}
+        }
+    }
+    return nil
+}
+
+func (self *Harness) Client(protocol string) *http.Client {
+    return &http.Client{
+        Transport: &http.Transport{
+            Proxy:             http.ProxyURL(self.ProxyUrl(protocol)),
+            DisableKeepAlives: true,
+        },
+        Timeout: 20 * time.Second,
+    }
+}
+
+func (self *Harness) Get(t *testing.T, client *http.Client, path string) string {
+    resp, err := client.Get(self.Origin_.URL + path)
+    if err != nil {
+        t.Fatalf("get %s: %v", path, err)
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatalf("get %s: %v", path, err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("get %s: %s", path, resp.Status)
+    }
+    return string(body)
+}
+
+// Socks5Reply sends the socks5 command cmd, CONNECT or UDP ASSOCIATE, for
+// target and returns the reply code.
+func (self *Harness) Socks5Reply(t *testing.T, cmd byte, target string) byte {
+    host, sport, err := net.SplitHostPort(target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    port, _ := strconv.Atoi(sport)
+    conn, err := net.DialTimeout("tcp", self.ProxyUrl("socks5").Host, 5*time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    _ = conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+    _, err = conn.Write([]byte{0x05, 0x01, 0x00})
+    if err != nil {
+        t.Fatal(err)
+    }
+    method := make([]byte, 2)
+    _, err = io.ReadFull(conn, method)
+    if err != nil || method[1] != 0x00 {
+        t.Fatalf("socks5 method % x: %v", method, err)
+    }
+    req := []byte{0x05, cmd, 0x00, 0x03, byte(len(host))}
+    req = append(append(req, host...), byte(port>>8), byte(port))
+    _, err = conn.Write(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    reply := make([]byte, 2)
+    _, err = io.ReadFull(conn, reply)
+    if err != nil {
+        t.Fatalf("socks5 command %d %s: %v", cmd, target, err)
+    }
+    return reply[1]
+}
+
+func (self *Harness) Conns() []*tunnel.TunnelConnection {
+    self.Tunnel_.TunnelMutex_.RLock()
+    defer self.Tunnel_.TunnelMutex_.RUnlock()
+    return append([]*tunnel.TunnelConnection{}, self.Tunnel_.TunnelConns_...)
+}
+
+// WaitConns waits until the tunnel has n live connections.
+func (self *Harness) WaitConns(t *testing.T, n int, timeout time.Duration) []*tunnel.TunnelConnection {
+    deadline := time.Now().Add(timeout)
+    for {
+        conns := self.Conns()
+        if len(conns) == n {
+            return conns
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d tunnel connections after %v, want %d", len(conns), timeout, n)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
@@ -0,0 +1,724 @@
+package integration
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/ginuerzh/gosocks5"
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/agent"
+    "lambdaproxy/proxy"
+    "lambdaproxy/tunnel"
+    "lambdaproxy/wire"
+)
+
+func TestHttpAndSocks(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{})
+    conns := h.WaitConns(t, 1, 10*time.Second)
+    if conns[0].ExitIP_ != _ExitIP {
+        t.Errorf("exit ip %q, want %q", conns[0].ExitIP_, _ExitIP)
+    }
+
+    for _, protocol := range []string{"http", "socks5"} {
+        if got := h.Get(t, h.Client(protocol), "/"+protocol); got != "hello /"+protocol {
+            t.Errorf("%s proxy answered %q", protocol, got)
+        }
+    }
+}
+
+func TestAgentModes(t *testing.T) {
+    for _, mode := range []string{wire.ModeSocks5, wire.ModeAuto} {
+        t.Run(mode, func(t *testing.T) {
+            h := NewHarness(t, HarnessConfig{AgentMode: mode})
+            conns := h.WaitConns(t, 1, 10*time.Second)
+            if mode == wire.ModeSocks5 && conns[0].ExitIP_ != _ExitIP {
+                t.Errorf("exit ip %q, want %q", conns[0].ExitIP_, _ExitIP)
+            }
+            if got := h.Get(t, h.Client("http"), "/mode"); got != "hello /mode" {
+                t.Errorf("proxy answered %q", got)
+            }
+        })
+    }
+}
+
+func TestConcurrentStreams(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{})
+    h.WaitConns(t, 1, 10*time.Second)
+
+    var wg sync.WaitGroup
+    var failed int64
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            protocol := "http"
+            if i%2 == 1 {
+                protocol = "socks5"
+            }
+            path := fmt.Sprintf("/%d", i)
+            resp, err := h.Client(protocol).Get(h.Origin_.URL + path)
+            if err != nil {
+                t.Errorf("%s: %v", path, err)
+                atomic.AddInt64(&failed, 1)
+                return
+            }
+            resp.Body.Close()
+        }(i)
+    }
+    wg.Wait()
+    if failed > 0 {
+        t.Fatalf("%d of 50 concurrent requests failed", failed)
+    }
+}
+
+// TestRotation checks that a new lambda takes over once a tunnel is older
+// than the interval, without failing requests.
+func TestRotation(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{Regions: []string{"test-1", "test-2"}, ConnTimeoutS: 6, Timeout: 8 * time.Second})
+    first := h.WaitConns(t, 1, 10*time.Second)[0]
+
+    deadline := time.Now().Add(20 * time.Second)
+    for {
+        h.Get(t, h.Client("http"), "/rotate")
+        conns := h.Conns()
+        if len(conns) == 1 && conns[0] != first {
+            if conns[0].Region_ == first.Region_ {
+                t.Errorf("rotated within region %s", first.Region_)
+            }
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("tunnel %d not rotated, %d connections", first.Id_, len(conns))
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+    if n := atomic.LoadInt64(&h.Backend_.Invocations_); n < 2 {
+        t.Errorf("%d invocations", n)
+    }
+}
+
+// TestAgentDeath kills an agent under an active request: the request
+// fails, the tunnel drops the connection and the next invocation serves.
+func TestAgentDeath(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{ConnTimeoutS: 4})
+    conn := h.WaitConns(t, 1, 10*time.Second)[0]
+
+    result := make(chan error, 1)
+    go func() {
+        resp, err := h.Client("http").Get(h.Origin_.URL + "/slow")
+        if err == nil {
+            resp.Body.Close()
+            err = fmt.Errorf("slow request answered %s", resp.Status)
+        }
+        result <- err
+    }()
+    time.Sleep(300 * time.Millisecond)
+
+    if !h.SSH_.Cut(conn.Conn_.RemoteAddr().String(), true) {
+        t.Fatal("no ssh connection for the tunnel")
+    }
+    select {
+    case err := <-result:
+        t.Logf("in flight request: %v", err)
+    case <-time.After(3 * time.Second):
+        t.Fatal("request through a dead agent still pending")
+    }
+
+    h.WaitConns(t, 0, 2*time.Second)
+    waitFor(t, 2*time.Second, func() bool { return atomic.LoadInt64(&h.Backend_.Failures_) > 0 })
+
+    if got := h.Get(t, h.Client("socks5"), "/after"); got != "hello /after" {
+        t.Errorf("proxy answered %q", got)
+    }
+    if conns := h.Conns(); len(conns) != 1 || conns[0] == conn {
+        t.Errorf("dead tunnel still in use")
+    }
+}
+
+// TestPingFailure cuts the tunnel connection while the agent still runs,
+// the ping fails and the tunnel is dropped.
+func TestPingFailure(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{ConnTimeoutS: 4})
+    conn := h.WaitConns(t, 1, 10*time.Second)[0]
+
+    if !h.SSH_.Cut(conn.Conn_.RemoteAddr().String(), false) {
+        t.Fatal("no ssh connection for the tunnel")
+    }
+    h.WaitConns(t, 0, 2*time.Second)
+
+    h.Tunnel_.TunnelMutex_.RLock()
+    alive := h.Tunnel_.Sessions_[conn]
+    h.Tunnel_.TunnelMutex_.RUnlock()
+    if alive {
+        t.Error("session of the failed tunnel not closed")
+    }
+
+    // the agent notices its tunnel is gone and the invocation ends
+    waitFor(t, 2*time.Second, func() bool { return atomic.LoadInt64(&h.Backend_.Failures_) > 0 })
+
+    if got := h.Get(t, h.Client("http"), "/after"); got != "hello /after" {
+        t.Errorf("proxy answered %q", got)
+    }
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+    deadline := time.Now().Add(timeout)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("condition not met after %v", timeout)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
+
+func TestExitIPDiscovery(t *testing.T) {
+    tests := []struct {
+        Name    string
+        Mode    string
+        Forward string
+        ExitIP  func(origin string) string
+        Want    string
+    }{
+        {"fallback", wire.ModeHttp, "", func(origin string) string { return "http://127.0.0.1:1/ip," + origin + "/ip" }, _ExitIP},
+        // the forward mode can't reach the echo url, only the agent can
+        {"agent", wire.ModeForward, "origin", func(origin string) string { return "agent," + origin + "/ip" }, _ExitIP},
+        {"static", wire.ModeHttp, "", func(origin string) string { return "static:198.51.100.1" }, "198.51.100.1"},
+        {"none", wire.ModeHttp, "", func(origin string) string { return "none" }, ""},
+    }
+    for _, test := range tests {
+        t.Run(test.Name, func(t *testing.T) {
+            h := NewHarness(t, HarnessConfig{AgentMode: test.Mode, Forward: test.Forward, ExitIP: test.ExitIP})
+            conns := h.WaitConns(t, 1, 15*time.Second)
+            if conns[0].ExitIP_ != test.Want {
+                t.Errorf("exit ip %q, want %q", conns[0].ExitIP_, test.Want)
+            }
+        })
+    }
+}
+
+func TestUdpAssociate(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{})
+    h.WaitConns(t, 1, 10*time.Second)
+
+    echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer echo.Close()
+    go func() {
+        buf := make([]byte, 2048)
+        for {
+            n, from, err := echo.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            echo.WriteTo(buf[:n], from)
+        }
+    }()
+
+    control, err := net.Dial("tcp", h.ProxyUrl("socks5").Host)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer control.Close()
+    conn, err := gost.SOCKS5UDPConnector(nil).ConnectContext(context.Background(), control, "udp", echo.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    buf := make([]byte, 2048)
+    for i := 0; i < 3; i++ {
+        msg := fmt.Sprintf("datagram %d", i)
+        _, err = conn.Write([]byte(msg))
+        if err != nil {
+            t.Fatal(err)
+        }
+        _ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        n, err := conn.Read(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if string(buf[:n]) != msg {
+            t.Errorf("echo %q, want %q", buf[:n], msg)
+        }
+    }
+}
+
+func TestDnsServer(t *testing.T) {
+    // the nameserver of the agent answers nxdomain to everything
+    nameserver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer nameserver.Close()
+    go func() {
+        buf := make([]byte, 512)
+        for {
+            n, from, err := nameserver.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            buf[2] |= 0x80
+            buf[3] = 0x83
+            nameserver.WriteTo(buf[:n], from)
+        }
+    }()
+    resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+    err = os.WriteFile(resolvConf, []byte("nameserver "+nameserver.LocalAddr().String()+"\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func(path string) { agent.ResolvConf = path }(agent.ResolvConf)
+    agent.ResolvConf = resolvConf
+
+    h := NewHarness(t, HarnessConfig{})
+    h.WaitConns(t, 1, 10*time.Second)
+    dns, err := proxy.NewDnsServer([]string{"udp://127.0.0.1:0", "tcp://127.0.0.1:0", "http://127.0.0.1:0/dns-query"}, h.Proxyer_)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer dns.Close()
+
+    // example.com A IN
+    query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+        7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+    for _, addr := range dns.Addrs_ {
+        u, err := url.Parse(addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        var answer []byte
+        switch u.Scheme {
+        case "udp":
+            conn, err := net.Dial("udp", u.Host)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+            _ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+            conn.Write(query)
+            answer = make([]byte, 512)
+            n, err := conn.Read(answer)
+            if err != nil {
+                t.Fatalf("%s: %v", addr, err)
+            }
+            answer = answer[:n]
+        case "tcp":
+            conn, err := net.Dial("tcp", u.Host)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+            _ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+            wire.WriteDnsMessage(conn, query)
+            answer, err = wire.ReadDnsMessage(conn)
+            if err != nil {
+                t.Fatalf("%s: %v", addr, err)
+            }
+        case "http":
+            resp, err := http.Post(addr, "application/dns-message", bytes.NewReader(query))
+            if err != nil {
+                t.Fatalf("%s: %v", addr, err)
+            }
+            answer, _ = io.ReadAll(resp.Body)
+            resp.Body.Close()
+        }
+
+        if len(answer) < 12 || answer[0] != 0x12 || answer[1] != 0x34 || answer[3]&0x0f != 3 {
+            t.Errorf("%s answered % x, want nxdomain", addr, answer)
+        }
+    }
+}
+
+func TestStreamHeader(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{})
+    h.WaitConns(t, 1, 10*time.Second)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    stream, _, err := h.Tunnel_.GetStream(ctx, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, err := (&tunnel.DialConnector{}).ConnectContext(ctx, stream, "tcp", h.Origin_.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    io.WriteString(conn, "GET /header HTTP/1.0\r\n\r\n")
+    resp, _ := io.ReadAll(conn)
+    if !strings.HasSuffix(string(resp), "hello /header") {
+        t.Errorf("origin answered %q", resp)
+    }
+
+    // nothing listens on port 1
+    stream, _, err = h.Tunnel_.GetStream(ctx, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stream.Close()
+    _, err = (&tunnel.DialConnector{}).ConnectContext(ctx, stream, "tcp", "127.0.0.1:1")
+    if !errors.Is(err, wire.ErrDialFailed) {
+        t.Errorf("dial error %v, want %v", err, wire.ErrDialFailed)
+    }
+}
+
+// TestEgressPolicy checks the agent refuses what the policy denies and the
+// listeners answer it with 403 and "not allowed", a target that is allowed
+// but down with 503 and "host unreachable".
+func TestEgressPolicy(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{
+        Egress: func(origin string) *wire.EgressPolicy {
+            _, port, _ := net.SplitHostPort(origin)
+            policy, err := tunnel.ParseEgressPolicy("10.0.0.0/8,127.0.0.2/32", "127.0.0.1,127.0.0.2", port+",1")
+            if err != nil {
+                t.Fatal(err)
+            }
+            return policy
+        },
+    })
+    h.WaitConns(t, 1, 10*time.Second)
+    origin := h.Origin_.Listener.Addr().String()
+    _, port, _ := net.SplitHostPort(origin)
+
+    for _, protocol := range []string{"http", "socks5"} {
+        if got := h.Get(t, h.Client(protocol), "/allowed"); got != "hello /allowed" {
+            t.Errorf("%s proxy answered %q", protocol, got)
+        }
+    }
+
+    tests := []struct {
+        Name   string
+        Target string
+        Status int
+        Reply  byte
+    }{
+        {"denied cidr", "127.0.0.2:" + port, http.StatusForbidden, 0x02},
+        {"denied port", "127.0.0.1:2", http.StatusForbidden, 0x02},
+        {"denied domain", "example.com:" + port, http.StatusForbidden, 0x02},
+        {"down", "127.0.0.1:1", http.StatusServiceUnavailable, 0x04},
+    }
+    for _, test := range tests {
+        resp, err := h.Client("http").Get("http://" + test.Target + "/")
+        if err != nil {
+            t.Fatalf("%s: %v", test.Name, err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != test.Status {
+            t.Errorf("%s: http proxy answered %s, want %d", test.Name, resp.Status, test.Status)
+        }
+        if reply := h.Socks5Reply(t, gosocks5.CmdConnect, test.Target); reply != test.Reply {
+            t.Errorf("%s: socks5 proxy replied %d, want %d", test.Name, reply, test.Reply)
+        }
+    }
+}
+
+func TestForwardListener(t *testing.T) {
+    h := NewHarness(t, HarnessConfig{
+        // the socks agent mode shows the forward needs no proxy protocol
+        AgentMode: wire.ModeSocks5,
+        Listeners: func(origin string) []string {
+            forwardUrl, err := proxy.ParseForward("127.0.0.1:0=" + origin)
+            if err != nil {
+                t.Fatal(err)
+            }
+            return []string{forwardUrl}
+        },
+    })
+    h.WaitConns(t, 1, 10*time.Second)
+
+    forward := h.ProxyUrl("tcp")
+    client := &http.Client{Timeout: 20 * time.Second}
+    resp, err := client.Get("http://" + forward.Host + "/forward")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if string(body) != "hello /forward" {
+        t.Errorf("forward answered %q", body)
+    }
+}
+
+func TestMitm(t *testing.T) {
+    echo := func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "secret=%q lambda=%q", r.Header.Get("X-Secret"), r.Header.Get("X-Lambda"))
+    }
+    intercepted := httptest.NewTLSServer(http.HandlerFunc(echo))
+    defer intercepted.Close()
+    passed := httptest.NewTLSServer(http.HandlerFunc(echo))
+    defer passed.Close()
+
+    dir := t.TempDir()
+    roots := filepath.Join(dir, "roots.pem")
+    err := os.WriteFile(roots, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intercepted.Certificate().Raw}), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rules := filepath.Join(dir, "mitm.txt")
+    _, passedPort, _ := net.SplitHostPort(passed.Listener.Addr().String())
+    err = os.WriteFile(rules, []byte("remove X-Secret\nset X-Lambda=on\npass port:"+passedPort+"\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca := filepath.Join(dir, "ca.pem")
+    listenerUrl := "http://127.0.0.1:0?mitm=true&mitm-ca=" + ca + "&mitm-key=" + filepath.Join(dir, "ca-key.pem") +
+        "&mitm-rules=" + rules + "&mitm-roots=" + roots
+
+    accessLog := filepath.Join(dir, "access.log")
+    h := NewHarness(t, HarnessConfig{
+        Listeners: func(origin string) []string {
+            return []string{listenerUrl}
+        },
+        AccessLog: accessLog,
+    })
+    h.WaitConns(t, 1, 10*time.Second)
+
+    caPem, err := os.ReadFile(ca)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool := x509.NewCertPool()
+    pool.AppendCertsFromPEM(caPem)
+    pool.AddCert(passed.Certificate())
+    client := &http.Client{
+        Transport: &http.Transport{
+            Proxy:             http.ProxyURL(h.ListenerProxyUrl(listenerUrl)),
+            TLSClientConfig:   &tls.Config{RootCAs: pool},
+            DisableKeepAlives: true,
+        },
+        Timeout: 20 * time.Second,
+    }
+
+    get := func(origin *httptest.Server) (string, *x509.Certificate) {
+        req, _ := http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+        req.Header.Set("X-Secret", "hunter2")
+        resp, err := client.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return string(body), resp.TLS.PeerCertificates[0]
+    }
+
+    body, cert := get(intercepted)
+    if body != `secret="" lambda="on"` {
+        t.Errorf("intercepted request reached the origin as %s", body)
+    }
+    if cert.Equal(intercepted.Certificate()) {
+        t.Error("intercepted tunnel kept the origin certificate")
+    }
+
+    body, cert = get(passed)
+    if body != `secret="hunter2" lambda=""` {
+        t.Errorf("passed request reached the origin as %s", body)
+    }
+    if !cert.Equal(passed.Certificate()) {
+        t.Error("passed tunnel was intercepted")
+    }
+
+    if body := h.Get(t, client, "/plain"); body != "hello /plain" {
+        t.Errorf("plain request answered %q", body)
+    }
+
+    // every intercepted request has an entry of its own, passed tunnels are
+    // only logged as a session
+    want := map[string]bool{
+        intercepted.URL + "/": false,
+        h.Origin_.URL + "/plain": false,
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        data, _ := os.ReadFile(accessLog)
+        for _, line := range strings.Split(string(data), "\n") {
+            var entry proxy.AccessEntry
+            if json.Unmarshal([]byte(line), &entry) != nil || entry.Url == "" {
+                continue
+            }
+            if _, ok := want[entry.Url]; !ok {
+                t.Fatalf("unexpected entry %s", line)
+            }
+            if entry.Method != http.MethodGet || entry.Status != http.StatusOK || entry.BytesDown == 0 {
+                t.Errorf("entry %s", line)
+            }
+            want[entry.Url] = true
+        }
+        if want[intercepted.URL+"/"] && want[h.Origin_.URL+"/plain"] {
+            break
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+    for url, logged := range want {
+        if !logged {
+            t.Errorf("%s not in the access log", url)
+        }
+    }
+}
+
+func TestHeaderPolicy(t *testing.T) {
+    origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "via=%q xff=%q ua=%q keep=%q auth=%q", r.Header.Get("Via"), r.Header.Get("X-Forwarded-For"),
+            r.Header.Get("User-Agent"), r.Header.Get("X-Keep"), r.Header.Get("Proxy-Authorization"))
+    }))
+    defer origin.Close()
+
+    headers, err := tunnel.ParseHeaderPolicy(tunnel.DefaultStripHeaders, "Mozilla/5.0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    h := NewHarness(t, HarnessConfig{Headers: headers})
+    h.WaitConns(t, 1, 10*time.Second)
+
+    request := func() *http.Request {
+        req, _ := http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+        req.Header.Set("Via", "1.1 client-proxy")
+        req.Header.Set("X-Forwarded-For", "192.0.2.1")
+        req.Header.Set("User-Agent", "curl/8.0")
+        req.Header.Set("X-Keep", "yes")
+        return req
+    }
+    want := `via="" xff="" ua="Mozilla/5.0" keep="yes" auth=""`
+
+    // through the server, the stream flagged as plain http
+    resp, err := h.Client("http").Do(request())
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(body) != want {
+        t.Errorf("server listener: origin saw %s", body)
+    }
+
+    // straight to the goproxy of the http mode
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    stream, _, err := h.Tunnel_.GetStream(ctx, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stream.Close()
+    req := request()
+    req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+    err = req.WriteProxy(stream)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp, err = http.ReadResponse(bufio.NewReader(stream), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ = io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(body) != want {
+        t.Errorf("http mode: origin saw %s", body)
+    }
+}
+
+// CountingHandler counts the connections a gost handler serves.
+type CountingHandler struct {
+    gost.Handler
+    Count_ int64
+}
+
+func (self *CountingHandler) Handle(conn net.Conn) {
+    atomic.AddInt64(&self.Count_, 1)
+    self.Handler.Handle(conn)
+}
+
+func TestUpstream(t *testing.T) {
+    authenticator := gost.NewLocalAuthenticator(map[string]string{"up": "secret"})
+    upstreams := map[string]gost.Handler{
+        "http":   gost.HTTPHandler(gost.AuthenticatorHandlerOption(authenticator)),
+        "socks5": gost.SOCKS5Handler(gost.AuthenticatorHandlerOption(authenticator)),
+    }
+    for protocol, handler := range upstreams {
+        t.Run(protocol, func(t *testing.T) {
+            ln, err := gost.TCPListener("127.0.0.1:0")
+            if err != nil {
+                t.Fatal(err)
+            }
+            server := &gost.Server{Listener: ln}
+            defer server.Close()
+            counting := &CountingHandler{Handler: handler}
+            go server.Serve(counting)
+
+            upstream, err := tunnel.ParseUpstream([]string{protocol + "://up:secret@" + ln.Addr().String()})
+            if err != nil {
+                t.Fatal(err)
+            }
+            h := NewHarness(t, HarnessConfig{Upstream: upstream})
+            h.WaitConns(t, 1, 10*time.Second)
+
+            if body := h.Get(t, h.Client("http"), "/upstream"); body != "hello /upstream" {
+                t.Errorf("origin answered %q", body)
+            }
+            if atomic.LoadInt64(&counting.Count_) == 0 {
+                t.Error("the agent did not dial through the upstream")
+            }
+
+            // udp and dns would bypass the upstream, the server refuses them
+            // and so does the agent
+            if reply := h.Socks5Reply(t, gosocks5.CmdUdp, "0.0.0.0:0"); reply != gosocks5.NotAllowed {
+                t.Errorf("udp associate replied %d", reply)
+            }
+            if _, err := proxy.NewDnsServer([]string{"udp://127.0.0.1:0"}, h.Proxyer_); !errors.Is(err, wire.ErrUdpBypass) {
+                t.Errorf("dns server started: %v", err)
+            }
+            ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+            defer cancel()
+            for _, request := range []func(io.ReadWriter) (*bufio.Reader, error){wire.RequestUdp, wire.RequestDns} {
+                stream, _, err := h.Tunnel_.GetStream(ctx, nil)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                _, err = request(stream)
+                stream.Close()
+                if !errors.Is(err, wire.ErrControlFailed) {
+                    t.Errorf("agent answered: %v", err)
+                }
+            }
+        })
+    }
+
+    // unless they may leave the lambda directly
+    h := NewHarness(t, HarnessConfig{Upstream: []string{"socks5://127.0.0.1:1"}, DirectUdp: true})
+    h.WaitConns(t, 1, 10*time.Second)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    stream, _, err := h.Tunnel_.GetStream(ctx, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stream.Close()
+    if _, err = wire.RequestUdp(stream); err != nil {
+        t.Errorf("udp with direct udp: %v", err)
+    }
+
+    _, err = tunnel.ParseUpstream([]string{"ss://aes-128-cfb:pass@127.0.0.1:8388"})
+    if err == nil {
+        t.Error("shadowsocks upstream accepted")
+    }
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package integration
+
+import (
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "testing"
+    "time"
+)
+
+const (
+    // set in the copy of the test binary running in its own network namespace
+    _NetnsEnv = "LAMBDAPROXY_TEST_NETNS"
+    // source of the redirected client, so the agent's own dial isn't redirected
+    _RedirectedSource = "127.0.0.3"
+)
+
+// TestTransparentListener redirects a connection to a red:// listener with
+// iptables and checks the original destination reaches the agent. It needs
+// root, unshare and iptables, and reruns itself in a network namespace so
+// the rule doesn't touch the host.
+func TestTransparentListener(t *testing.T) {
+    if os.Getenv(_NetnsEnv) == "" {
+        if os.Geteuid() != 0 {
+            t.Skip("needs root")
+        }
+        for _, tool := range []string{"unshare", "ip", "iptables"} {
+            if _, err := exec.LookPath(tool); err != nil {
+                t.Skipf("needs %s", tool)
+            }
+        }
+        cmd := exec.Command("unshare", "-n", os.Args[0], "-test.run=^TestTransparentListener$", "-test.v")
+        cmd.Env = append(os.Environ(), _NetnsEnv+"=1")
+        out, err := cmd.CombinedOutput()
+        if err != nil {
+            t.Fatalf("%v\n%s", err, out)
+        }
+        return
+    }
+
+    if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+        t.Fatalf("%v: %s", err, out)
+    }
+    listenerUrl := "red://127.0.0.1:0"
+    h := NewHarness(t, HarnessConfig{
+        Listeners: func(origin string) []string {
+            return []string{listenerUrl}
+        },
+    })
+    h.WaitConns(t, 1, 10*time.Second)
+
+    // answers with the client address, which is the agent's only if the
+    // connection went through the listener
+    remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host, _, _ := net.SplitHostPort(r.RemoteAddr)
+        io.WriteString(w, host)
+    }))
+    defer remote.Close()
+
+    _, listenerPort, _ := net.SplitHostPort(h.ListenerProxyUrl(listenerUrl).Host)
+    origin := remote.Listener.Addr().String()
+    originHost, originPort, _ := net.SplitHostPort(origin)
+    out, err := exec.Command("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-s", _RedirectedSource,
+        "-d", originHost, "--dport", originPort, "-j", "REDIRECT", "--to-ports", listenerPort).CombinedOutput()
+    if err != nil {
+        t.Fatalf("%v: %s", err, out)
+    }
+
+    dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(_RedirectedSource)}}
+    client := &http.Client{
+        Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+        Timeout:   20 * time.Second,
+    }
+    resp, err := client.Get(remote.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if string(body) == _RedirectedSource {
+        t.Errorf("connection reached %s without the listener", origin)
+    }
+}
@@ -0,0 +1,196 @@
+// Package lambdaproxy routes connections of a Go program through the lambda
+// pool without running the proxy server:
+//
+//   lp, err := lambdaproxy.New(ctx, &lambdaproxy.Config{
+//       Accounts: []*backend.AccountConfig{{Name: "default", Role: "awslambdaproxy-role", Regions: []string{"us-west-2"}}},
+//       AgentZip: agentZip,
+//   })
+//   if err != nil {
+//       return err
+//   }
+//   defer lp.Close()
+//   client := &http.Client{Transport: &http.Transport{DialContext: lp.Dialer()}}
+//
+// Like the server it needs an ssh server on this host the agents can reach,
+// they log in as the current user with a key added for the process lifetime.
+package lambdaproxy
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+
+    "lambdaproxy/backend"
+    "lambdaproxy/tunnel"
+    "lambdaproxy/wire"
+)
+
+const (
+    _DefaultFunctionName = "lambdaproxy"
+    _DefaultIntervalS    = 60
+    _DefaultMemorySize   = 256
+    _DefaultSSHPort      = "22"
+    _DefaultRolePolicy   = "basic"
+    _ShutdownTimeout     = 10 * time.Second
+)
+
+// Config mirrors the server flags, zero values take the server defaults.
+// Without AgentZip the functions already deployed are invoked.
+type Config struct {
+    Accounts     []*backend.AccountConfig
+    FunctionName string
+    AgentZip     []byte
+    IntervalS    int64
+    MemorySize   int64
+    TunnelSize   int64
+    SSHPort      string
+    CreateRole   bool
+    RolePolicy   string
+    AgentMode    string
+    AgentForward string
+    Egress       *wire.EgressPolicy
+    Upstream     []string
+    DirectUdp    bool
+    Regions      []string
+    ServerIP     string
+    ExitIP       string
+}
+
+func (self *Config) SetDefaults() error {
+    if self.FunctionName == "" {
+        self.FunctionName = _DefaultFunctionName
+    }
+    if self.IntervalS <= 0 {
+        self.IntervalS = _DefaultIntervalS
+    }
+    if self.MemorySize <= 0 {
+        self.MemorySize = _DefaultMemorySize
+    }
+    if self.TunnelSize <= 0 {
+        self.TunnelSize = 1
+    }
+    if self.SSHPort == "" {
+        self.SSHPort = _DefaultSSHPort
+    }
+    if self.RolePolicy == "" {
+        self.RolePolicy = _DefaultRolePolicy
+    }
+    if self.AgentMode == "" {
+        self.AgentMode = wire.ModeHttp
+    }
+    if self.ServerIP == "" {
+        self.ServerIP = tunnel.DefaultIPDiscovery
+    }
+    if self.ExitIP == "" {
+        self.ExitIP = tunnel.DefaultIPDiscovery
+    }
+    if self.Egress == nil {
+        egress, err := tunnel.ParseEgressPolicy(tunnel.DefaultEgressDeny, "", "")
+        if err != nil {
+            return err
+        }
+        self.Egress = egress
+    }
+    return nil
+}
+
+// LambdaProxy keeps invoking agents until closed and dials through them.
+type LambdaProxy struct {
+    Config_ *Config
+    Lambda_ *backend.AwsLambda
+    Tunnel_ *tunnel.Tunnel
+    Cancel_ context.CancelFunc
+}
+
+// New deploys the agents and starts invoking them, ctx only bounds the
+// deploy.
+func New(ctx context.Context, cfg *Config) (*LambdaProxy, error) {
+    if len(cfg.Accounts) == 0 {
+        return nil, errors.New("no aws accounts configured")
+    }
+    err := cfg.SetDefaults()
+    if err != nil {
+        return nil, err
+    }
+
+    serverIP, err := tunnel.ParseIPDiscoverer(cfg.ServerIP)
+    if err != nil {
+        return nil, err
+    }
+    exitIP, err := tunnel.ParseIPDiscoverer(cfg.ExitIP)
+    if err != nil {
+        return nil, err
+    }
+    upstream, err := tunnel.ParseUpstream(cfg.Upstream)
+    if err != nil {
+        return nil, err
+    }
+
+    awsLambda, err := backend.NewAwsLambda(ctx, cfg.Accounts, cfg.FunctionName, cfg.AgentZip, cfg.IntervalS+20, cfg.MemorySize, cfg.CreateRole, cfg.RolePolicy)
+    if err != nil {
+        return nil, fmt.Errorf("unable to new AwsLambda: %w", err)
+    }
+
+    t, err := tunnel.NewTunnel(awsLambda, cfg.TunnelSize, cfg.SSHPort, cfg.IntervalS, serverIP)
+    if err != nil {
+        return nil, fmt.Errorf("unable to setup tunneler: %w", err)
+    }
+    err = t.SetAgentMode(cfg.AgentMode, cfg.AgentForward)
+    if err != nil {
+        _ = t.Close()
+        return nil, err
+    }
+    t.SetEgressPolicy(cfg.Egress)
+    t.SetUpstream(upstream, cfg.DirectUdp)
+    t.SetExitIPDiscoverer(exitIP)
+
+    runCtx, cancel := context.WithCancel(context.Background())
+    go t.Run(runCtx)
+
+    var lp = new(LambdaProxy)
+    lp.Config_ = cfg
+    lp.Lambda_ = awsLambda
+    lp.Tunnel_ = t
+    lp.Cancel_ = cancel
+    return lp, nil
+}
+
+// DialContext connects to address through an agent in one of the configured
+// regions, waiting for a tunnel to come up until ctx is done.
+func (self *LambdaProxy) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+    switch network {
+    case "tcp", "tcp4", "tcp6":
+    default:
+        return nil, fmt.Errorf("network %s not supported", network)
+    }
+
+    stream, _, err := self.Tunnel_.GetStream(ctx, self.Config_.Regions)
+    if err != nil {
+        return nil, err
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        _ = stream.SetDeadline(deadline)
+    }
+
+    conn, err := tunnel.StreamConnector(self.Tunnel_.AgentMode_).ConnectContext(ctx, stream, "tcp", address)
+    if err != nil {
+        stream.Close()
+        return nil, err
+    }
+    _ = stream.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+// Dialer returns DialContext for an http.Transport or any other dialer hook.
+func (self *LambdaProxy) Dialer() func(ctx context.Context, network string, address string) (net.Conn, error) {
+    return self.DialContext
+}
+
+// Close stops invoking agents, asks the running ones to exit and revokes
+// their ssh key.
+func (self *LambdaProxy) Close() error {
+    self.Cancel_()
+    return self.Tunnel_.Shutdown(_ShutdownTimeout)
+}
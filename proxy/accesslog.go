@@ -0,0 +1,237 @@
+package proxy
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    _AccessLogRotateSuffix = "20060102-150405"
+)
+
+// AccessEntry is one line of the access log, written when a proxy session
+// ends and, on a mitm listener, for every request it intercepts.
+type AccessEntry struct {
+    Time       string `json:"time"`
+    Session    uint64 `json:"session"`
+    Client     string `json:"client"`
+    Listener   string `json:"listener"`
+    User       string `json:"user,omitempty"`
+    Protocol   string `json:"protocol"`
+    Target     string `json:"target,omitempty"`
+    Method     string `json:"method,omitempty"`
+    Url        string `json:"url,omitempty"`
+    Status     int    `json:"status,omitempty"`
+    Route      string `json:"route,omitempty"`
+    Tunnel     uint64 `json:"tunnel,omitempty"`
+    Region     string `json:"region,omitempty"`
+    ExitIP     string `json:"exit_ip,omitempty"`
+    BytesUp    int64  `json:"bytes_up"`
+    BytesDown  int64  `json:"bytes_down"`
+    DurationMs int64  `json:"duration_ms"`
+    Reason     string `json:"reason"`
+}
+
+// AccessLog writes json lines to Path_ and rotates the file once it grows
+// past MaxSize_ bytes or gets older than MaxAge_. Only the newest Backups_
+// rotated files are kept.
+type AccessLog struct {
+    Path_    string
+    MaxSize_ int64
+    MaxAge_  time.Duration
+    Backups_ int
+    Mutex_   sync.Mutex
+    File_    *os.File
+    Size_    int64
+    Opened_  time.Time
+}
+
+func NewAccessLog(path string, maxSize int64, maxAge time.Duration, backups int) (*AccessLog, error) {
+    var accessLog = new(AccessLog)
+    accessLog.Path_ = path
+    accessLog.MaxSize_ = maxSize
+    accessLog.MaxAge_ = maxAge
+    accessLog.Backups_ = backups
+
+    err := accessLog.Open()
+    if err != nil {
+        return nil, err
+    }
+    return accessLog, nil
+}
+
+// Open appends to the current file. The caller holds Mutex_ unless the log
+// is not shared yet.
+func (self *AccessLog) Open() error {
+    f, err := os.OpenFile(self.Path_, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+    if err != nil {
+        return fmt.Errorf("cannot open access log: %w", err)
+    }
+    stat, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return fmt.Errorf("cannot open access log: %w", err)
+    }
+
+    self.File_ = f
+    self.Size_ = stat.Size()
+    self.Opened_ = time.Now()
+    if self.Size_ > 0 {
+        self.Opened_ = stat.ModTime()
+    }
+    return nil
+}
+
+func (self *AccessLog) Write(entry *AccessEntry) {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        log.Printf("access log: %v", err)
+        return
+    }
+    line = append(line, '\n')
+
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if self.File_ == nil {
+        return
+    }
+    if self.NeedRotate(int64(len(line))) {
+        err = self.Rotate()
+        if err != nil {
+            log.Printf("access log: %v", err)
+            if self.File_ == nil {
+                return
+            }
+        }
+    }
+
+    n, err := self.File_.Write(line)
+    self.Size_ += int64(n)
+    if err != nil {
+        log.Printf("access log: %v", err)
+    }
+}
+
+func (self *AccessLog) NeedRotate(size int64) bool {
+    if self.Size_ == 0 {
+        return false
+    }
+    if self.MaxSize_ > 0 && self.Size_+size > self.MaxSize_ {
+        return true
+    }
+    return self.MaxAge_ > 0 && time.Since(self.Opened_) > self.MaxAge_
+}
+
+// Rotate renames the current file with a timestamp suffix, opens a new one
+// and removes the rotated files beyond Backups_. Files rotated within the
+// same second get a counter after the timestamp. When the rename fails the
+// log goes on in the file at Path_.
+func (self *AccessLog) Rotate() error {
+    self.File_.Close()
+    self.File_ = nil
+
+    stamp := time.Now().Format(_AccessLogRotateSuffix)
+    rotated := self.Path_ + "." + stamp
+    if same, _ := filepath.Glob(rotated + "*"); len(same) > 0 {
+        counter := 0
+        for _, name := range same {
+            if backupStamp, n, ok := self.BackupOrder(name); ok && backupStamp == stamp {
+                counter = max(counter, n)
+            }
+        }
+        rotated = fmt.Sprintf("%s-%d", rotated, counter+1)
+    }
+    err := os.Rename(self.Path_, rotated)
+    if err != nil {
+        err = fmt.Errorf("cannot rotate access log: %w", err)
+        if openErr := self.Open(); openErr != nil {
+            return errors.Join(err, openErr)
+        }
+        return err
+    }
+
+    err = self.Open()
+    if err != nil {
+        return err
+    }
+
+    if self.Backups_ > 0 {
+        self.RemoveBackups()
+    }
+    return nil
+}
+
+// BackupOrder splits the name of a rotated file in its timestamp and the
+// counter of the rotations within that second.
+func (self *AccessLog) BackupOrder(name string) (string, int, bool) {
+    suffix, ok := strings.CutPrefix(name, self.Path_+".")
+    if !ok || len(suffix) < len(_AccessLogRotateSuffix) {
+        return "", 0, false
+    }
+    stamp, counter := suffix[:len(_AccessLogRotateSuffix)], suffix[len(_AccessLogRotateSuffix):]
+    if _, err := time.Parse(_AccessLogRotateSuffix, stamp); err != nil {
+        return "", 0, false
+    }
+    if counter == "" {
+        return stamp, 0, true
+    }
+    n, err := strconv.Atoi(strings.TrimPrefix(counter, "-"))
+    if err != nil || n <= 0 || !strings.HasPrefix(counter, "-") {
+        return "", 0, false
+    }
+    return stamp, n, true
+}
+
+func (self *AccessLog) RemoveBackups() {
+    backups, err := filepath.Glob(self.Path_ + ".*")
+    if err != nil {
+        return
+    }
+    type backup struct {
+        Name    string
+        Stamp   string
+        Counter int
+    }
+    var names []backup
+    for _, name := range backups {
+        if stamp, counter, ok := self.BackupOrder(name); ok {
+            names = append(names, backup{name, stamp, counter})
+        }
+    }
+    sort.Slice(names, func(i, j int) bool {
+        if names[i].Stamp != names[j].Stamp {
+            return names[i].Stamp < names[j].Stamp
+        }
+        return names[i].Counter < names[j].Counter
+    })
+
+    for len(names) > self.Backups_ {
+        err = os.Remove(names[0].Name)
+        if err != nil {
+            log.Printf("access log: %v", err)
+        }
+        names = names[1:]
+    }
+}
+
+func (self *AccessLog) Close() error {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if self.File_ == nil {
+        return nil
+    }
+    err := self.File_.Close()
+    self.File_ = nil
+    return err
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sort"
+    "testing"
+    "time"
+)
+
+func ReadAccessEntries(t *testing.T, path string) []uint64 {
+    f, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    var sessions []uint64
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var entry AccessEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            t.Fatalf("%s: %v", path, err)
+        }
+        sessions = append(sessions, entry.Session)
+    }
+    return sessions
+}
+
+func TestAccessLogRotateSize(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "access.log")
+    if err := os.WriteFile(path+".old", nil, 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    line, _ := json.Marshal(&AccessEntry{Session: 1})
+    // two entries per file
+    accessLog, err := NewAccessLog(path, int64(2*(len(line)+1)), 0, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer accessLog.Close()
+
+    for i := uint64(1); i <= 9; i++ {
+        accessLog.Write(&AccessEntry{Session: i})
+    }
+
+    if sessions := ReadAccessEntries(t, path); len(sessions) != 1 || sessions[0] != 9 {
+        t.Errorf("current file has %v", sessions)
+    }
+    backups, _ := filepath.Glob(path + ".2*")
+    if len(backups) != 2 {
+        t.Fatalf("backups %v", backups)
+    }
+    // the newest backups are kept, even when rotated within one second
+    var kept []uint64
+    for _, backup := range backups {
+        kept = append(kept, ReadAccessEntries(t, backup)...)
+    }
+    sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+    if len(kept) != 4 || kept[0] != 5 || kept[3] != 8 {
+        t.Errorf("backups hold %v", kept)
+    }
+    if _, err := os.Stat(path + ".old"); err != nil {
+        t.Errorf("unrelated file removed: %v", err)
+    }
+}
+
+func TestAccessLogRotateAge(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "access.log")
+    accessLog, err := NewAccessLog(path, 0, time.Hour, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer accessLog.Close()
+
+    // an empty file is never rotated
+    accessLog.Opened_ = time.Now().Add(-2 * time.Hour)
+    accessLog.Write(&AccessEntry{Session: 1})
+    accessLog.Opened_ = time.Now()
+    accessLog.Write(&AccessEntry{Session: 2})
+    if sessions := ReadAccessEntries(t, path); len(sessions) != 2 {
+        t.Fatalf("current file has %v", sessions)
+    }
+
+    accessLog.Opened_ = time.Now().Add(-2 * time.Hour)
+    accessLog.Write(&AccessEntry{Session: 3})
+    if sessions := ReadAccessEntries(t, path); len(sessions) != 1 || sessions[0] != 3 {
+        t.Errorf("current file has %v", sessions)
+    }
+    if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+        t.Errorf("backups %v", backups)
+    }
+
+    // a file kept across restarts is as old as its last write
+    accessLog.Close()
+    old := time.Now().Add(-2 * time.Hour)
+    if err = os.Chtimes(path, old, old); err != nil {
+        t.Fatal(err)
+    }
+    accessLog, err = NewAccessLog(path, 0, time.Hour, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer accessLog.Close()
+    accessLog.Write(&AccessEntry{Session: 4})
+    if backups, _ := filepath.Glob(path + ".*"); len(backups) != 2 {
+        t.Errorf("backups %v", backups)
+    }
+}
+
+func TestAccessLogRotateFailed(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "access.log")
+    accessLog, err := NewAccessLog(path, 0, time.Hour, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer accessLog.Close()
+    accessLog.Write(&AccessEntry{Session: 1})
+
+    // the rename fails once the file is gone, logging goes on in a new one
+    if err = os.Remove(path); err != nil {
+        t.Fatal(err)
+    }
+    accessLog.Opened_ = time.Now().Add(-2 * time.Hour)
+    accessLog.Write(&AccessEntry{Session: 2})
+    accessLog.Write(&AccessEntry{Session: 3})
+    if sessions := ReadAccessEntries(t, path); len(sessions) != 2 || sessions[0] != 2 {
+        t.Errorf("current file has %v", sessions)
+    }
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+const (
+    _ApiTopHosts = 100
+)
+
+type UserUsage struct {
+    Name         string `json:"name"`
+    Month        string `json:"month"`
+    UsageCounter
+    MonthlyQuota int64  `json:"monthly_quota,omitempty"`
+    Remaining    int64  `json:"remaining,omitempty"`
+    Bandwidth    int64  `json:"bandwidth,omitempty"`
+    ActiveConns  int64  `json:"active_conns"`
+    Expires      string `json:"expires,omitempty"`
+}
+
+type HostUsage struct {
+    Host string `json:"host"`
+    UsageCounter
+}
+
+// ApiServer answers usage queries over http. With a token every request
+// needs an "Authorization: Bearer <token>" header.
+type ApiServer struct {
+    Token_    string
+    Users_    *UserDB
+    Usage_    *UsageDB
+    Listener_ net.Listener
+    Server_   *http.Server
+    Mux_      *http.ServeMux
+}
+
+func NewApiServer(addr string, token string, users *UserDB, usage *UsageDB) (*ApiServer, error) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    var api = new(ApiServer)
+    api.Token_ = token
+    api.Users_ = users
+    api.Usage_ = usage
+    api.Listener_ = ln
+    api.Mux_ = http.NewServeMux()
+    api.Mux_.HandleFunc("GET /api/usage", api.Authorized(api.HandleUsers))
+    api.Mux_.HandleFunc("GET /api/usage/{name}", api.Authorized(api.HandleUser))
+    api.Mux_.HandleFunc("GET /api/hosts", api.Authorized(api.HandleHosts))
+    api.Server_ = &http.Server{Handler: api.Mux_}
+
+    log.Printf("api listen: %s", ln.Addr().String())
+    return api, nil
+}
+
+func (self *ApiServer) Serve() {
+    err := self.Server_.Serve(self.Listener_)
+    if err != nil && !errors.Is(err, http.ErrServerClosed) {
+        log.Printf("api server stopped: %v", err)
+    }
+}
+
+func (self *ApiServer) Close() error {
+    return self.Server_.Close()
+}
+
+func (self *ApiServer) Authorized(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if self.Token_ != "" {
+            token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+            if subtle.ConstantTimeCompare([]byte(token), []byte(self.Token_)) != 1 {
+                http.Error(w, "unauthorized", http.StatusUnauthorized)
+                return
+            }
+        }
+        handler(w, r)
+    }
+}
+
+func (self *ApiServer) UserUsage(name string, month string, counter UsageCounter) *UserUsage {
+    usage := &UserUsage{
+        Name:         name,
+        Month:        month,
+        UsageCounter: counter,
+    }
+    if self.Users_ == nil {
+        return usage
+    }
+    if user := self.Users_.Get(name); user != nil {
+        usage.MonthlyQuota = user.MonthlyQuota_
+        if user.MonthlyQuota_ > 0 {
+            usage.Remaining = max(user.MonthlyQuota_-counter.Month(), 0)
+        }
+        usage.Bandwidth = user.Bandwidth_
+        if !user.Expires_.IsZero() {
+            usage.Expires = user.Expires_.Format("2006-01-02T15:04:05Z07:00")
+        }
+    }
+    usage.ActiveConns = self.Users_.ActiveConns(name)
+    return usage
+}
+
+func (self *ApiServer) HandleUsers(w http.ResponseWriter, r *http.Request) {
+    snapshot := self.Usage_.Snapshot()
+
+    names := make([]string, 0, len(snapshot.Users))
+    for name := range snapshot.Users {
+        names = append(names, name)
+    }
+    if self.Users_ != nil {
+        for _, name := range self.Users_.Names() {
+            if snapshot.Users[name] == nil {
+                names = append(names, name)
+            }
+        }
+    }
+    sort.Strings(names)
+
+    result := make([]*UserUsage, 0, len(names))
+    for _, name := range names {
+        var counter UsageCounter
+        if v := snapshot.Users[name]; v != nil {
+            counter = *v
+        }
+        result = append(result, self.UserUsage(name, snapshot.Month, counter))
+    }
+    WriteJson(w, result)
+}
+
+func (self *ApiServer) HandleUser(w http.ResponseWriter, r *http.Request) {
+    name := r.PathValue("name")
+    snapshot := self.Usage_.Snapshot()
+
+    counter := snapshot.Users[name]
+    known := self.Users_ != nil && self.Users_.Get(name) != nil
+    if counter == nil && !known {
+        http.Error(w, "unknown user", http.StatusNotFound)
+        return
+    }
+    if counter == nil {
+        counter = new(UsageCounter)
+    }
+    WriteJson(w, self.UserUsage(name, snapshot.Month, *counter))
+}
+
+func (self *ApiServer) HandleHosts(w http.ResponseWriter, r *http.Request) {
+    limit := _ApiTopHosts
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            http.Error(w, "bad limit", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+
+    snapshot := self.Usage_.Snapshot()
+    result := make([]*HostUsage, 0)
+    for _, host := range self.Usage_.TopHosts(limit) {
+        if counter := snapshot.Hosts[host]; counter != nil {
+            result = append(result, &HostUsage{Host: host, UsageCounter: *counter})
+        }
+    }
+    WriteJson(w, result)
+}
+
+func WriteJson(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "    ")
+    err := enc.Encode(v)
+    if err != nil {
+        log.Printf("api: unable to write response: %v", err)
+    }
+}
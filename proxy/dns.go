@@ -0,0 +1,279 @@
+package proxy
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/wire"
+)
+
+const (
+    _DnsTimeout     = 10 * time.Second
+    _DnsIdleTimeout = 30 * time.Second
+    _DnsContentType = "application/dns-message"
+    _DnsDefaultPath = "/dns-query"
+    // udp queries resolving at once, more are answered with servfail
+    _DnsMaxInflight = 256
+)
+
+// DnsServer answers dns queries through the tunnel, resolved by an agent in
+// its region so names resolve like they do at the exit. Its urls are
+// udp://addr, tcp://addr, https://addr/path (dns over https, ?cert= and
+// ?key= or a generated certificate) and http://addr/path behind a tls
+// terminating proxy.
+type DnsServer struct {
+    Proxyer_ *Proxyer
+    Addrs_   []string
+    Closers_ []io.Closer
+}
+
+func NewDnsServer(urls []string, proxyer *Proxyer) (*DnsServer, error) {
+    if !proxyer.Tunnel_.UdpAllowed() {
+        return nil, wire.ErrUdpBypass
+    }
+
+    var dns = new(DnsServer)
+    dns.Proxyer_ = proxyer
+
+    for _, v := range urls {
+        err := dns.Listen(v)
+        if err != nil {
+            dns.Close()
+            return nil, fmt.Errorf("dns listener %s: %w", v, err)
+        }
+        log.Printf("dns listen: %s", dns.Addrs_[len(dns.Addrs_)-1])
+    }
+    return dns, nil
+}
+
+func (self *DnsServer) Listen(dnsUrl string) error {
+    u, err := url.Parse(dnsUrl)
+    if err != nil {
+        return err
+    }
+
+    switch u.Scheme {
+    case "udp":
+        conn, err := net.ListenPacket("udp", u.Host)
+        if err != nil {
+            return err
+        }
+        self.Closers_ = append(self.Closers_, conn)
+        self.Addrs_ = append(self.Addrs_, "udp://"+conn.LocalAddr().String())
+        go self.ServeUdp(conn)
+    case "tcp":
+        ln, err := net.Listen("tcp", u.Host)
+        if err != nil {
+            return err
+        }
+        self.Closers_ = append(self.Closers_, ln)
+        self.Addrs_ = append(self.Addrs_, "tcp://"+ln.Addr().String())
+        go self.ServeTcp(ln)
+    case "http", "https":
+        ln, err := net.Listen("tcp", u.Host)
+        if err != nil {
+            return err
+        }
+        if u.Scheme == "https" {
+            tlsConfig, err := DnsTLSConfig(u.Query())
+            if err != nil {
+                ln.Close()
+                return err
+            }
+            ln = tls.NewListener(ln, tlsConfig)
+        }
+        path := u.Path
+        if path == "" {
+            path = _DnsDefaultPath
+        }
+        mux := http.NewServeMux()
+        mux.HandleFunc(path, self.HandleDoh)
+        server := &http.Server{Handler: mux}
+        self.Closers_ = append(self.Closers_, server)
+        self.Addrs_ = append(self.Addrs_, u.Scheme+"://"+ln.Addr().String()+path)
+        go func() {
+            err := server.Serve(ln)
+            if err != nil && !errors.Is(err, http.ErrServerClosed) {
+                log.Printf("dns server stopped: %v", err)
+            }
+        }()
+    default:
+        return fmt.Errorf("unsupported dns scheme %q", u.Scheme)
+    }
+    return nil
+}
+
+func DnsTLSConfig(query url.Values) (*tls.Config, error) {
+    certFile, keyFile := query.Get("cert"), query.Get("key")
+    var cert tls.Certificate
+    var err error
+    if certFile != "" && keyFile != "" {
+        cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+    } else {
+        log.Printf("dns over https has no cert/key, using a generated self-signed certificate")
+        cert, err = gost.GenCertificate()
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (self *DnsServer) Close() {
+    for _, closer := range self.Closers_ {
+        closer.Close()
+    }
+}
+
+// Resolve sends query to an agent on a stream of its own. Without an
+// answer it replies servfail, so clients don't wait for their timeout.
+func (self *DnsServer) Resolve(ctx context.Context, query []byte) []byte {
+    answer, err := self.Exchange(ctx, query)
+    if err != nil {
+        log.Printf("dns: %v", err)
+        return DnsServfail(query)
+    }
+    return answer
+}
+
+func (self *DnsServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+    ctx, cancel := context.WithTimeout(ctx, _DnsTimeout)
+    defer cancel()
+
+    self.Proxyer_.MarkRequest()
+    stream, _, err := self.Proxyer_.Tunnel_.GetStream(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer stream.Close()
+    deadline, _ := ctx.Deadline()
+    _ = stream.SetDeadline(deadline)
+
+    reader, err := wire.RequestDns(stream)
+    if err != nil {
+        return nil, err
+    }
+    err = wire.WriteDnsMessage(stream, query)
+    if err != nil {
+        return nil, err
+    }
+    answer, err := wire.ReadDnsMessage(reader)
+    if err != nil {
+        return nil, err
+    }
+    if len(answer) == 0 {
+        return nil, errors.New("agent could not resolve")
+    }
+    return answer, nil
+}
+
+func (self *DnsServer) ServeUdp(conn net.PacketConn) {
+    buf := make([]byte, wire.MaxDatagramSize)
+    inflight := make(chan struct{}, _DnsMaxInflight)
+    for {
+        n, from, err := conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        if n < 12 {
+            continue
+        }
+        query := append([]byte{}, buf[:n]...)
+        select {
+        case inflight <- struct{}{}:
+        default:
+            _, _ = conn.WriteTo(DnsServfail(query), from)
+            continue
+        }
+        go func() {
+            defer func() { <-inflight }()
+            _, _ = conn.WriteTo(self.Resolve(context.Background(), query), from)
+        }()
+    }
+}
+
+func (self *DnsServer) ServeTcp(ln net.Listener) {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        go func() {
+            defer conn.Close()
+            for {
+                _ = conn.SetReadDeadline(time.Now().Add(_DnsIdleTimeout))
+                query, err := wire.ReadDnsMessage(conn)
+                if err != nil || len(query) < 12 {
+                    return
+                }
+                err = wire.WriteDnsMessage(conn, self.Resolve(context.Background(), query))
+                if err != nil {
+                    return
+                }
+            }
+        }()
+    }
+}
+
+// HandleDoh answers rfc 8484 requests, the query in the dns parameter of a
+// GET or the body of a POST.
+func (self *DnsServer) HandleDoh(w http.ResponseWriter, r *http.Request) {
+    var query []byte
+    var err error
+    switch r.Method {
+    case http.MethodGet:
+        query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+    case http.MethodPost:
+        if r.Header.Get("Content-Type") != _DnsContentType {
+            http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+            return
+        }
+        query, err = io.ReadAll(io.LimitReader(r.Body, wire.MaxDatagramSize))
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if err != nil || len(query) < 12 {
+        http.Error(w, "bad dns query", http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", _DnsContentType)
+    _, _ = w.Write(self.Resolve(r.Context(), query))
+}
+
+// DnsServfail builds the servfail answer to query, echoing its question.
+func DnsServfail(query []byte) []byte {
+    answer := append([]byte{}, query[:12]...)
+    // QR, the opcode and RD of the query, RA and rcode 2
+    answer[2] = 0x80 | query[2]&0x79
+    answer[3] = 0x80 | 0x02
+    // no answer, authority or additional records
+    for i := 6; i < 12; i++ {
+        answer[i] = 0
+    }
+
+    // echo the question if there is exactly one, otherwise none
+    end := 12
+    if query[4] == 0 && query[5] == 1 {
+        for end < len(query) && query[end] != 0 {
+            end += 1 + int(query[end])
+        }
+        end += 5
+    }
+    if end > len(query) || end == 12 {
+        answer[4], answer[5] = 0, 0
+        return answer
+    }
+    return append(answer, query[12:end]...)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+    "fmt"
+    "net"
+    "strings"
+
+    "github.com/ginuerzh/gost"
+)
+
+// IsForward tells whether node is a tcp://bind/host:port listener sending
+// every connection to one fixed target, gost's syntax for port forwards.
+func IsForward(node *gost.Node) bool {
+    return node.Protocol == "tcp"
+}
+
+// ParseForward turns an ssh style [bind:]port=host:port forward into the
+// listener url serving it. Without a bind address it listens on loopback
+// like ssh does, forwards can't authenticate clients, so listening on other
+// interfaces has to be asked for with 0.0.0.0 or [::].
+func ParseForward(spec string) (string, error) {
+    bind, target, ok := strings.Cut(spec, "=")
+    if !ok {
+        return "", fmt.Errorf("forward %q is not [bind:]port=host:port", spec)
+    }
+    if !strings.Contains(bind, ":") {
+        bind = ":" + bind
+    }
+    host, port, err := net.SplitHostPort(bind)
+    if err != nil {
+        return "", fmt.Errorf("forward %q: %w", spec, err)
+    }
+    if host == "" {
+        bind = net.JoinHostPort("127.0.0.1", port)
+    }
+    err = CheckForwardTarget(target)
+    if err != nil {
+        return "", fmt.Errorf("forward %q: %w", spec, err)
+    }
+    return "tcp://" + bind + "/" + target, nil
+}
+
+func CheckForwardTarget(target string) error {
+    host, port, err := net.SplitHostPort(target)
+    if err != nil {
+        return err
+    }
+    if host == "" || port == "" {
+        return fmt.Errorf("forward target %q needs a host and port", target)
+    }
+    return nil
+}
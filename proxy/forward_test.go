@@ -0,0 +1,34 @@
+package proxy
+
+import (
+    "testing"
+)
+
+func TestParseForward(t *testing.T) {
+    tests := []struct {
+        Spec string
+        Url  string
+    }{
+        {"5432=db.example.com:5432", "tcp://127.0.0.1:5432/db.example.com:5432"},
+        {":5432=db.example.com:5432", "tcp://127.0.0.1:5432/db.example.com:5432"},
+        {"0.0.0.0:5432=db.example.com:5432", "tcp://0.0.0.0:5432/db.example.com:5432"},
+        {"[::]:8443=[2001:db8::1]:443", "tcp://[::]:8443/[2001:db8::1]:443"},
+        {"10.0.0.5:25=mail.example.com:25", "tcp://10.0.0.5:25/mail.example.com:25"},
+        {"5432", ""},
+        {"5432=db.example.com", ""},
+        {"5432=:5432", ""},
+        {"a:b:c=db.example.com:5432", ""},
+    }
+    for _, test := range tests {
+        got, err := ParseForward(test.Spec)
+        if test.Url == "" {
+            if err == nil {
+                t.Errorf("%q accepted as %q", test.Spec, got)
+            }
+            continue
+        }
+        if err != nil || got != test.Url {
+            t.Errorf("%q: got %q, %v, want %q", test.Spec, got, err, test.Url)
+        }
+    }
+}
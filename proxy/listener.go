@@ -0,0 +1,390 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/tls"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/ginuerzh/gost"
+)
+
+// ProxyListener is one client facing listener, configured from a gost node
+// url such as socks5://user:pass@:1080 or http+tls://:8443?cert=c.pem&key=k.pem.
+// Listeners without credentials of their own use the users database.
+type ProxyListener struct {
+    Url_           string
+    Node_          gost.Node
+    Server_        *gost.Server
+    Proxyer_       *Proxyer
+    Authenticator_ gost.Authenticator
+    Users_         *UserDB
+    Options_       []gost.HandlerOption
+    Mitm_          *Mitm
+}
+
+func NewProxyListener(listenerUrl string, proxyer *Proxyer, users *UserDB) (*ProxyListener, error) {
+    node, err := gost.ParseNode(listenerUrl)
+    if err != nil {
+        return nil, fmt.Errorf("gost.ParseNode: %+v", err)
+    }
+
+    authenticator, err := ParseListenerAuth(&node)
+    if err != nil {
+        return nil, fmt.Errorf("listener %s auth: %+v", node.Addr, err)
+    }
+
+    tlsConfig, err := ListenerTLSConfig(&node)
+    if err != nil {
+        return nil, fmt.Errorf("listener %s tls: %+v", node.Addr, err)
+    }
+
+    if IsTransparent(&node) || IsForward(&node) {
+        // redirected and forwarded clients don't know there is a proxy to
+        // log in to
+        if authenticator != nil {
+            return nil, fmt.Errorf("listener %s: %s listeners cannot authenticate users", node.Addr, node.Protocol)
+        }
+        users = nil
+    }
+    if IsForward(&node) {
+        err = CheckForwardTarget(node.Remote)
+        if err != nil {
+            return nil, fmt.Errorf("listener %s: %+v", node.Addr, err)
+        }
+    }
+    if authenticator != nil {
+        users = nil
+    }
+    if (authenticator != nil || users != nil) && strings.HasPrefix(node.Protocol, "socks4") {
+        return nil, fmt.Errorf("listener %s: socks4 cannot authenticate users", node.Addr)
+    }
+
+    if !IsTransparent(&node) && !IsForward(&node) {
+        _, err = NewGostHandler(&node)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    var mitm *Mitm
+    if node.GetBool("mitm") {
+        if node.Protocol != "http" && node.Protocol != "" {
+            return nil, fmt.Errorf("listener %s: only http listeners can intercept tls", node.Addr)
+        }
+        mitm, err = NewMitm(&node)
+        if err != nil {
+            return nil, fmt.Errorf("listener %s: %+v", node.Addr, err)
+        }
+    }
+
+    ln, err := NewGostListener(&node, tlsConfig)
+    if err != nil {
+        return nil, fmt.Errorf("listener %s: %+v", node.Addr, err)
+    }
+
+    log.Printf("proxy listener %s protocol=%s transport=%s users=%v mitm=%v", ln.Addr().String(), ListenerProtocol(&node), node.Transport, authenticator != nil || users != nil, mitm != nil)
+
+    return &ProxyListener{
+        Url_:           listenerUrl,
+        Node_:          node,
+        Server_:        &gost.Server{Listener: ln},
+        Proxyer_:       proxyer,
+        Authenticator_: authenticator,
+        Users_:         users,
+        Options_: []gost.HandlerOption{
+            gost.AddrHandlerOption(ln.Addr().String()),
+            gost.UsersHandlerOption(node.User),
+            gost.TLSConfigHandlerOption(tlsConfig),
+            gost.NodeHandlerOption(node),
+            gost.TimeoutHandlerOption(node.GetDuration("timeout")),
+        },
+        Mitm_:          mitm,
+    }, nil
+}
+
+// Init makes the listener its own gost.Handler, the handler options are
+// fixed when the listener is created.
+func (self *ProxyListener) Init(options ...gost.HandlerOption) {
+}
+
+// Handle serves one client with a handler and chain of its own, so the
+// user who authenticates decides where the connection goes.
+func (self *ProxyListener) Handle(conn net.Conn) {
+    session := NewProxySession(self, conn)
+    defer session.Close()
+
+    var handler gost.Handler
+    var err error
+    if IsTransparent(&self.Node_) {
+        // redirected clients may wait for the server to speak first, so
+        // nothing is peeked
+        tproxy := self.Node_.GetBool("tproxy")
+        session.Protocol_ = "REDIRECT"
+        if tproxy {
+            session.Protocol_ = "TPROXY"
+        }
+        handler = &TransparentHandler{Listener_: self, Session_: session, TProxy_: tproxy}
+    } else if IsForward(&self.Node_) {
+        session.Protocol_ = "FORWARD"
+        handler = &TransparentHandler{Listener_: self, Session_: session, Target_: self.Node_.Remote}
+    } else {
+        reader := bufio.NewReader(conn)
+        session.Protocol_ = DetectProtocol(&self.Node_, reader)
+        conn = &PeekedConn{Conn: conn, Reader_: reader}
+
+        handler, err = self.NewHandler(session)
+        if err != nil {
+            conn.Close()
+            return
+        }
+        if _, ok := handler.(*MitmHandler); !ok && (session.Protocol_ == "HTTP" || session.Protocol_ == "CONNECT") {
+            conn = &ForbiddenConn{Conn: conn, Session_: session}
+        }
+    }
+
+    var authenticator gost.Authenticator = self.Authenticator_
+    if self.Users_ != nil {
+        authenticator = &SessionAuthenticator{Session_: session, Users_: self.Users_, Usage_: self.Proxyer_.Usage_}
+    }
+
+    options := append([]gost.HandlerOption{}, self.Options_...)
+    handler.Init(append(options,
+        gost.ChainHandlerOption(self.Proxyer_.NewSessionChain(session)),
+        gost.AuthenticatorHandlerOption(authenticator),
+    )...)
+
+    self.Proxyer_.Serve(session, func() {
+        handler.Handle(conn)
+    })
+
+    if self.Proxyer_.AccessLog_ != nil {
+        self.Proxyer_.AccessLog_.Write(session.AccessEntry(time.Now()))
+    }
+}
+
+// NewHandler serves socks5 clients with Socks5Handler for udp, http clients
+// of a mitm listener with MitmHandler, the other protocols with the gost
+// handlers.
+func (self *ProxyListener) NewHandler(session *ProxySession) (gost.Handler, error) {
+    if self.Mitm_ != nil && (session.Protocol_ == "HTTP" || session.Protocol_ == "CONNECT") {
+        return &MitmHandler{Listener_: self, Session_: session}, nil
+    }
+    switch self.Node_.Protocol {
+    case "", "socks5":
+        if session.Protocol_ == "SOCKS5" {
+            return &Socks5Handler{Listener_: self, Session_: session}, nil
+        }
+    }
+    return NewGostHandler(&self.Node_)
+}
+
+type PeekedConn struct {
+    net.Conn
+    Reader_ *bufio.Reader
+}
+
+func (self *PeekedConn) Read(b []byte) (int, error) {
+    return self.Reader_.Read(b)
+}
+
+// ForbiddenConn answers a denied target with 403, the gost http handler
+// answers every failed dial with 503. The handler writes the status line of
+// its reply on its own.
+type ForbiddenConn struct {
+    net.Conn
+    Session_ *ProxySession
+    Replied_ bool
+}
+
+func (self *ForbiddenConn) Write(b []byte) (int, error) {
+    if !self.Replied_ {
+        self.Replied_ = true
+        if self.Session_.Denied() && bytes.HasPrefix(b, []byte("HTTP/1.1 503 ")) {
+            _, err := io.WriteString(self.Conn, "HTTP/1.1 403 Forbidden\r\n")
+            return len(b), err
+        }
+    }
+    return self.Conn.Write(b)
+}
+
+// DetectProtocol names what the client speaks for the access log, peeking
+// at the first bytes the way gost's auto handler does.
+func DetectProtocol(node *gost.Node, reader *bufio.Reader) string {
+    switch node.Protocol {
+    case "ss":
+        return "SS"
+    case "sni":
+        return "SNI"
+    }
+
+    head, err := reader.Peek(1)
+    if err != nil {
+        return ""
+    }
+    switch head[0] {
+    case 0x04:
+        return "SOCKS4"
+    case 0x05:
+        return "SOCKS5"
+    }
+    head, err = reader.Peek(len("CONNECT "))
+    if err == nil && string(head) == "CONNECT " {
+        return "CONNECT"
+    }
+    return "HTTP"
+}
+
+func (self *ProxyListener) Serve() {
+    err := self.Server_.Serve(self)
+    if err != nil {
+        log.Printf("proxy listener %s stopped: %v", self.Node_.Addr, err)
+    }
+}
+
+func (self *ProxyListener) Close() error {
+    return self.Server_.Close()
+}
+
+func ListenerProtocol(node *gost.Node) string {
+    if node.Protocol == "" {
+        return "auto"
+    }
+    return node.Protocol
+}
+
+// ParseListenerAuth accepts the users gost does: user:pass in the url, a
+// base64 ?auth= value, or a ?secrets= file reloaded on change.
+func ParseListenerAuth(node *gost.Node) (gost.Authenticator, error) {
+    if auth := node.Get("auth"); auth != "" && node.User == nil {
+        decoded, err := base64.StdEncoding.DecodeString(auth)
+        if err != nil {
+            return nil, err
+        }
+        if user, pass, ok := strings.Cut(string(decoded), ":"); ok {
+            node.User = url.UserPassword(user, pass)
+        } else {
+            node.User = url.User(user)
+        }
+    }
+
+    if secrets := node.Get("secrets"); secrets != "" {
+        f, err := os.Open(secrets)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+
+        authenticator := gost.NewLocalAuthenticator(nil)
+        err = authenticator.Reload(f)
+        if err != nil {
+            return nil, err
+        }
+        go gost.PeriodReload(authenticator, secrets)
+        return authenticator, nil
+    }
+
+    if node.User != nil {
+        kvs := make(map[string]string)
+        kvs[node.User.Username()], _ = node.User.Password()
+        return gost.NewLocalAuthenticator(kvs), nil
+    }
+    return nil, nil
+}
+
+func ListenerTLSConfig(node *gost.Node) (*tls.Config, error) {
+    certFile, keyFile := node.Get("cert"), node.Get("key")
+    if certFile != "" && keyFile != "" {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, err
+        }
+        return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+    }
+
+    switch node.Transport {
+    case "tls", "mtls", "wss", "mwss", "http2", "h2":
+    default:
+        return nil, nil
+    }
+    log.Printf("listener %s has no cert/key, using a generated self-signed certificate", node.Addr)
+    cert, err := gost.GenCertificate()
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func NewGostListener(node *gost.Node, tlsConfig *tls.Config) (gost.Listener, error) {
+    wsOpts := &gost.WSOptions{
+        EnableCompression: node.GetBool("compression"),
+        ReadBufferSize:    node.GetInt("rbuf"),
+        WriteBufferSize:   node.GetInt("wbuf"),
+        Path:              node.Get("path"),
+    }
+
+    if IsTransparent(node) || IsForward(node) {
+        if node.Transport != "tcp" {
+            return nil, fmt.Errorf("%s listeners take plain tcp, not %s", node.Protocol, node.Transport)
+        }
+        if IsTransparent(node) && node.GetBool("tproxy") {
+            return TransparentListener(node.Addr)
+        }
+    }
+
+    switch node.Transport {
+    case "tcp":
+        return gost.TCPListener(node.Addr)
+    case "tls":
+        return gost.TLSListener(node.Addr, tlsConfig)
+    case "mtls":
+        return gost.MTLSListener(node.Addr, tlsConfig)
+    case "ws":
+        return gost.WSListener(node.Addr, wsOpts)
+    case "mws":
+        return gost.MWSListener(node.Addr, wsOpts)
+    case "wss":
+        return gost.WSSListener(node.Addr, tlsConfig, wsOpts)
+    case "mwss":
+        return gost.MWSSListener(node.Addr, tlsConfig, wsOpts)
+    case "http2":
+        return gost.HTTP2Listener(node.Addr, tlsConfig)
+    case "h2":
+        return gost.H2Listener(node.Addr, tlsConfig, node.Get("path"))
+    case "h2c":
+        return gost.H2CListener(node.Addr, node.Get("path"))
+    default:
+        return nil, fmt.Errorf("unsupported listener transport %q", node.Transport)
+    }
+}
+
+// NewGostHandler only supports the proxy protocols, port forwarding and
+// tun/tap modes make no sense in front of the lambda tunnel.
+func NewGostHandler(node *gost.Node) (gost.Handler, error) {
+    switch node.Protocol {
+    case "":
+        return gost.AutoHandler(), nil
+    case "http":
+        return gost.HTTPHandler(), nil
+    case "http2":
+        return gost.HTTP2Handler(), nil
+    case "socks5":
+        return gost.SOCKS5Handler(), nil
+    case "socks4", "socks4a":
+        return gost.SOCKS4Handler(), nil
+    case "ss":
+        return gost.ShadowHandler(), nil
+    case "sni":
+        return gost.SNIHandler(), nil
+    default:
+        return nil, fmt.Errorf("unsupported listener protocol %q", node.Protocol)
+    }
+}
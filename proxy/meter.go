@@ -0,0 +1,130 @@
+package proxy
+
+import (
+    "errors"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var ErrQuotaExceeded = errors.New("monthly quota exceeded")
+
+// TokenBucket limits a user to Rate_ bytes per second over all of its
+// connections, with one second worth of burst.
+type TokenBucket struct {
+    Mutex_  sync.Mutex
+    Rate_   int64
+    Tokens_ float64
+    Last_   time.Time
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+    return &TokenBucket{
+        Rate_:   rate,
+        Tokens_: float64(rate),
+        Last_:   time.Now(),
+    }
+}
+
+// Wait takes n tokens, sleeping while the bucket is in debt. Tokens are
+// taken up front so concurrent callers queue behind each other.
+func (self *TokenBucket) Wait(n int) {
+    self.Mutex_.Lock()
+    now := time.Now()
+    self.Tokens_ += now.Sub(self.Last_).Seconds() * float64(self.Rate_)
+    if self.Tokens_ > float64(self.Rate_) {
+        self.Tokens_ = float64(self.Rate_)
+    }
+    self.Last_ = now
+    self.Tokens_ -= float64(n)
+    debt := -self.Tokens_
+    self.Mutex_.Unlock()
+
+    if debt > 0 {
+        time.Sleep(time.Duration(debt / float64(self.Rate_) * float64(time.Second)))
+    }
+}
+
+// MeteredConn accounts every byte of a tunneled connection to the session
+// user and target, applies the user's bandwidth limit and closes the
+// connection once the monthly quota is used up.
+type MeteredConn struct {
+    net.Conn
+    Session_ *ProxySession
+    Usage_   *UsageDB
+    Limiter_ *TokenBucket
+    Up_      int64
+    Down_    int64
+}
+
+func NewMeteredConn(conn net.Conn, session *ProxySession, usage *UsageDB) *MeteredConn {
+    var limiter *TokenBucket
+    if user := session.User(); user != nil {
+        limiter = usage.Limiter(user)
+    }
+    return &MeteredConn{
+        Conn:     conn,
+        Session_: session,
+        Usage_:   usage,
+        Limiter_: limiter,
+    }
+}
+
+func (self *MeteredConn) Read(b []byte) (int, error) {
+    if self.Limiter_ != nil && len(b) > int(self.Limiter_.Rate_) {
+        b = b[:self.Limiter_.Rate_]
+    }
+    n, err := self.Conn.Read(b)
+    if n > 0 {
+        atomic.AddInt64(&self.Down_, int64(n))
+        if qerr := self.Account(0, int64(n)); qerr != nil && err == nil {
+            err = qerr
+        }
+    }
+    return n, err
+}
+
+func (self *MeteredConn) Write(b []byte) (int, error) {
+    written := 0
+    for len(b) > 0 {
+        chunk := b
+        if self.Limiter_ != nil && len(chunk) > int(self.Limiter_.Rate_) {
+            chunk = chunk[:self.Limiter_.Rate_]
+        }
+        n, err := self.Conn.Write(chunk)
+        written += n
+        if n > 0 {
+            atomic.AddInt64(&self.Up_, int64(n))
+            if qerr := self.Account(int64(n), 0); qerr != nil && err == nil {
+                err = qerr
+            }
+        }
+        if err != nil {
+            return written, err
+        }
+        b = b[n:]
+    }
+    return written, nil
+}
+
+func (self *MeteredConn) Account(up int64, down int64) error {
+    user := self.Session_.User()
+    name := ""
+    if user != nil {
+        name = user.Name_
+    }
+
+    month := self.Usage_.Add(name, self.Session_.Target(), up, down)
+    if user != nil && user.MonthlyQuota_ > 0 && month >= user.MonthlyQuota_ {
+        log.Printf("session %d user=%s: %v, closing", self.Session_.Id_, name, ErrQuotaExceeded)
+        self.Session_.SetReason(ErrQuotaExceeded.Error())
+        self.Conn.Close()
+        return ErrQuotaExceeded
+    }
+    if self.Limiter_ != nil {
+        self.Limiter_.Wait(int(up + down))
+    }
+    return nil
+}
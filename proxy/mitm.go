@@ -0,0 +1,546 @@
+package proxy
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ginuerzh/gost"
+)
+
+const (
+    _MitmHeaderTimeout = 30 * time.Second
+    _MitmIdleTimeout   = 90 * time.Second
+    // how long a tunnel waits for the client hello before it is passed
+    // through, protocols where the server speaks first send none
+    _MitmPeekTimeout = 5 * time.Second
+
+    _MitmRemove = "remove"
+    _MitmSet    = "set"
+    _MitmAdd    = "add"
+    _MitmPass   = "pass"
+)
+
+// MitmRule rewrites a header of the requests to the targets matching all of
+// its conditions, or passes their tunnels through without interception.
+type MitmRule struct {
+    Rule
+    Action_ string
+    Header_ string
+    Value_  string
+}
+
+// ParseMitmRules reads one rule per line with the conditions of the routing
+// rules, "#" starts a comment and {user} in a value is the user's name:
+//   remove Via
+//   remove X-Forwarded-For
+//   set    X-Lambda-User={user}  user:alice
+//   add    X-Debug=1             suffix:api.example.com
+//   pass   suffix:bank.example.com
+func ParseMitmRules(r io.Reader) ([]*MitmRule, error) {
+    var rules []*MitmRule
+    scanner := bufio.NewScanner(r)
+    line := 0
+    for scanner.Scan() {
+        line++
+        text, _, _ := strings.Cut(scanner.Text(), "#")
+        fields := strings.Fields(text)
+        if len(fields) == 0 {
+            continue
+        }
+
+        rule := &MitmRule{Rule: Rule{Line_: line}, Action_: fields[0]}
+        conditions := fields[1:]
+        switch rule.Action_ {
+        case _MitmRemove, _MitmSet, _MitmAdd:
+            if len(conditions) == 0 {
+                return nil, fmt.Errorf("line %d: %s needs a header", line, rule.Action_)
+            }
+            header, value, hasValue := strings.Cut(conditions[0], "=")
+            if header == "" || hasValue == (rule.Action_ == _MitmRemove) {
+                return nil, fmt.Errorf("line %d: bad header %q", line, conditions[0])
+            }
+            rule.Header_, rule.Value_ = http.CanonicalHeaderKey(header), value
+            conditions = conditions[1:]
+        case _MitmPass:
+        default:
+            return nil, fmt.Errorf("line %d: unknown action %q", line, fields[0])
+        }
+
+        for _, field := range conditions {
+            matcher, err := ParseRuleMatcher(field)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", line, err)
+            }
+            rule.Matchers_ = append(rule.Matchers_, matcher)
+        }
+        rules = append(rules, rule)
+    }
+    return rules, scanner.Err()
+}
+
+// Mitm is the interception of one listener: its ca and its header rules,
+// reloaded like the routing rules. Every matching header rule applies, in
+// the order of the file.
+type Mitm struct {
+    CA_    *CertAuthority
+    Roots_ *x509.CertPool
+    Path_  string
+    Mutex_ sync.RWMutex
+    Rules_ []*MitmRule
+}
+
+// NewMitm reads the ?mitm-ca= and ?mitm-key= options of the listener, a ca
+// generated there if they don't exist, the ?mitm-rules= file and the
+// ?mitm-roots= pem file of cas trusted for the targets besides the system
+// ones, if set.
+func NewMitm(node *gost.Node) (*Mitm, error) {
+    certFile, keyFile := node.Get("mitm-ca"), node.Get("mitm-key")
+    if certFile == "" {
+        certFile = "mitm-ca.pem"
+    }
+    if keyFile == "" {
+        keyFile = "mitm-ca-key.pem"
+    }
+    ca, err := LoadCertAuthority(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+
+    var mitm = new(Mitm)
+    mitm.CA_ = ca
+    if rootsFile := node.Get("mitm-roots"); rootsFile != "" {
+        mitm.Roots_, err = LoadCertPool(rootsFile)
+        if err != nil {
+            return nil, err
+        }
+    }
+    mitm.Path_ = node.Get("mitm-rules")
+    if mitm.Path_ == "" {
+        return mitm, nil
+    }
+
+    f, err := os.Open(mitm.Path_)
+    if err != nil {
+        return nil, fmt.Errorf("cannot open mitm rules file: %w", err)
+    }
+    defer f.Close()
+
+    err = mitm.Reload(f)
+    if err != nil {
+        return nil, err
+    }
+    go gost.PeriodReload(mitm, mitm.Path_)
+    return mitm, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+    pool, err := x509.SystemCertPool()
+    if err != nil {
+        pool = x509.NewCertPool()
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("no certificates in %s", path)
+    }
+    return pool, nil
+}
+
+func (self *Mitm) Reload(r io.Reader) error {
+    rules, err := ParseMitmRules(r)
+    if err != nil {
+        return fmt.Errorf("cannot parse mitm rules file %s: %w", self.Path_, err)
+    }
+
+    self.Mutex_.Lock()
+    self.Rules_ = rules
+    self.Mutex_.Unlock()
+
+    log.Printf("loaded %d mitm rules from %s", len(rules), self.Path_)
+    return nil
+}
+
+func (self *Mitm) Period() time.Duration {
+    return _RulesReloadPeriod
+}
+
+func (self *Mitm) Rules() []*MitmRule {
+    self.Mutex_.RLock()
+    defer self.Mutex_.RUnlock()
+    return self.Rules_
+}
+
+// Intercept tells whether the tunnel to address is intercepted, it is
+// unless a pass rule matches.
+func (self *Mitm) Intercept(address string, user string) bool {
+    host, port := SplitTarget(address)
+    for _, rule := range self.Rules() {
+        if rule.Action_ == _MitmPass && rule.Match(host, port, user) {
+            return false
+        }
+    }
+    return true
+}
+
+// Rewrite applies the header rules matching the request to address.
+func (self *Mitm) Rewrite(header http.Header, address string, user string) {
+    host, port := SplitTarget(address)
+    for _, rule := range self.Rules() {
+        if !rule.Match(host, port, user) {
+            continue
+        }
+        value := strings.ReplaceAll(rule.Value_, "{user}", user)
+        switch rule.Action_ {
+        case _MitmRemove:
+            header.Del(rule.Header_)
+        case _MitmSet:
+            header.Set(rule.Header_, value)
+        case _MitmAdd:
+            header.Add(rule.Header_, value)
+        }
+    }
+}
+
+// MitmHandler serves the http clients of a ?mitm=true listener in place of
+// the gost handler. It proxies plain requests and intercepted tunnels
+// request by request through the session chain, rewriting their headers
+// and logging their urls, and pipes the tunnels the rules pass or that
+// don't start with tls.
+type MitmHandler struct {
+    Listener_ *ProxyListener
+    Session_  *ProxySession
+    Options_  *gost.HandlerOptions
+}
+
+func (self *MitmHandler) Init(options ...gost.HandlerOption) {
+    self.Options_ = new(gost.HandlerOptions)
+    for _, option := range options {
+        option(self.Options_)
+    }
+}
+
+func (self *MitmHandler) Handle(conn net.Conn) {
+    server := &http.Server{
+        Handler:           http.HandlerFunc(self.ServeProxy),
+        ReadHeaderTimeout: _MitmHeaderTimeout,
+        ErrorLog:          log.New(io.Discard, "", 0),
+    }
+    // a session has one target, a plain request to another host comes on a
+    // connection of its own
+    server.SetKeepAlivesEnabled(false)
+    _ = server.Serve(NewConnListener(conn))
+}
+
+func (self *MitmHandler) ServeProxy(w http.ResponseWriter, r *http.Request) {
+    if !self.Authenticate(r) {
+        w.Header().Set("Proxy-Authenticate", `Basic realm="lambdaproxy"`)
+        http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+        return
+    }
+
+    if r.Method == http.MethodConnect {
+        self.HandleConnect(w, r)
+        return
+    }
+    if r.URL.Host == "" || r.URL.Scheme != "http" {
+        http.Error(w, "not a proxy request", http.StatusBadRequest)
+        return
+    }
+    target := r.URL.Host
+    if r.URL.Port() == "" {
+        target = net.JoinHostPort(r.URL.Hostname(), "80")
+    }
+    transport := self.NewTransport(target)
+    defer transport.CloseIdleConnections()
+    self.LogRequests(self.NewReverseProxy("http", target, transport)).ServeHTTP(w, r)
+}
+
+func (self *MitmHandler) Authenticate(r *http.Request) bool {
+    if self.Options_.Authenticator == nil {
+        return true
+    }
+    auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+    if !ok {
+        return false
+    }
+    decoded, err := base64.StdEncoding.DecodeString(auth)
+    if err != nil {
+        return false
+    }
+    name, password, ok := strings.Cut(string(decoded), ":")
+    return ok && self.Options_.Authenticator.Authenticate(name, password)
+}
+
+func (self *MitmHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
+    target := r.Host
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "cannot tunnel", http.StatusInternalServerError)
+        return
+    }
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    // the client may send its hello before reading the reply
+    client := &PeekedConn{Conn: conn, Reader_: rw.Reader}
+
+    mitm := self.Listener_.Mitm_
+    if !mitm.Intercept(target, self.Session_.UserName()) {
+        self.Pipe(client, target)
+        return
+    }
+
+    _, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+    if err != nil {
+        return
+    }
+    _ = client.SetReadDeadline(time.Now().Add(_MitmPeekTimeout))
+    head, err := client.Reader_.Peek(1)
+    _ = client.SetReadDeadline(time.Time{})
+    if err != nil && len(head) == 0 && !IsTimeout(err) {
+        return
+    }
+    // 0x16 starts a tls handshake record
+    if len(head) == 0 || head[0] != 0x16 {
+        self.Tunnel(client, target)
+        return
+    }
+
+    host, _ := SplitTarget(target)
+    transport := self.NewTransport(target)
+    defer transport.CloseIdleConnections()
+    server := &http.Server{
+        Handler:           self.LogRequests(self.NewReverseProxy("https", target, transport)),
+        ReadHeaderTimeout: _MitmHeaderTimeout,
+        IdleTimeout:       _MitmIdleTimeout,
+        ErrorLog:          log.New(io.Discard, "", 0),
+    }
+    _ = server.Serve(NewConnListener(tls.Server(client, mitm.CA_.TLSConfig(host))))
+}
+
+// Pipe connects a passed tunnel after dialing, so a failure is answered.
+func (self *MitmHandler) Pipe(client net.Conn, target string) {
+    cc, err := self.Options_.Chain.Dial(target, gost.TimeoutChainOption(self.Options_.Timeout))
+    if err != nil {
+        status := "502 Bad Gateway"
+        if self.Session_.Denied() {
+            status = "403 Forbidden"
+        }
+        _, _ = io.WriteString(client, "HTTP/1.1 "+status+"\r\n\r\n")
+        return
+    }
+    _, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+    if err != nil {
+        cc.Close()
+        return
+    }
+    self.Listener_.Proxyer_.IOCopy(client, cc)
+}
+
+// Tunnel pipes a tunnel that was already answered.
+func (self *MitmHandler) Tunnel(client net.Conn, target string) {
+    cc, err := self.Options_.Chain.Dial(target, gost.TimeoutChainOption(self.Options_.Timeout))
+    if err != nil {
+        return
+    }
+    self.Listener_.Proxyer_.IOCopy(client, cc)
+}
+
+// NewTransport dials every request through the session chain to target,
+// one connection at a time since the session meters one.
+func (self *MitmHandler) NewTransport(target string) *http.Transport {
+    host, _ := SplitTarget(target)
+    return &http.Transport{
+        DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+            return self.Options_.Chain.DialContext(ctx, "tcp", target, gost.TimeoutChainOption(self.Options_.Timeout))
+        },
+        TLSClientConfig:    &tls.Config{ServerName: host, RootCAs: self.Listener_.Mitm_.Roots_},
+        MaxConnsPerHost:    1,
+        IdleConnTimeout:    _MitmIdleTimeout,
+        DisableCompression: true,
+    }
+}
+
+func (self *MitmHandler) NewReverseProxy(scheme, target string, transport *http.Transport) *httputil.ReverseProxy {
+    session := self.Session_
+    mitm := self.Listener_.Mitm_
+    return &httputil.ReverseProxy{
+        Director: func(req *http.Request) {
+            req.URL.Scheme = scheme
+            req.URL.Host = req.Host
+            if req.URL.Host == "" {
+                req.URL.Host = target
+            }
+            // the client's address stays private
+            if _, ok := req.Header["X-Forwarded-For"]; !ok {
+                req.Header["X-Forwarded-For"] = nil
+            }
+            mitm.Rewrite(req.Header, target, session.UserName())
+            log.Printf("session %d user=%s: %s %s", session.Id_, session.UserName(), req.Method, req.URL)
+        },
+        Transport: transport,
+        ErrorLog:  log.New(io.Discard, "", 0),
+        ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+            log.Printf("session %d user=%s: %s %s: %v", session.Id_, session.UserName(), req.Method, req.URL, err)
+            if logged, ok := w.(*LoggedResponseWriter); ok {
+                logged.Err_ = err
+            }
+            if session.Denied() {
+                w.WriteHeader(http.StatusForbidden)
+                return
+            }
+            w.WriteHeader(http.StatusBadGateway)
+        },
+    }
+}
+
+// LogRequests writes an access log entry for every intercepted request once
+// it is answered, with its url and status besides the session's fields.
+func (self *MitmHandler) LogRequests(handler http.Handler) http.Handler {
+    accessLog := self.Listener_.Proxyer_.AccessLog_
+    if accessLog == nil {
+        return handler
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        body := &CountedReadCloser{ReadCloser: r.Body}
+        if r.Body != nil && r.Body != http.NoBody {
+            r.Body = body
+        }
+        logged := &LoggedResponseWriter{ResponseWriter: w}
+        url := *r.URL
+        if url.Host == "" {
+            url.Scheme, url.Host = "https", r.Host
+        }
+
+        handler.ServeHTTP(logged, r)
+
+        entry := self.Session_.AccessEntry(time.Now())
+        entry.Time = start.UTC().Format(time.RFC3339Nano)
+        entry.Method = r.Method
+        entry.Url = url.String()
+        entry.Status = logged.Status_
+        if entry.Status == 0 {
+            entry.Status = http.StatusOK
+        }
+        entry.BytesUp = body.Size_
+        entry.BytesDown = logged.Size_
+        entry.DurationMs = time.Since(start).Milliseconds()
+        entry.Reason = "answered"
+        if logged.Err_ != nil {
+            entry.Reason = logged.Err_.Error()
+        }
+        accessLog.Write(entry)
+    })
+}
+
+// LoggedResponseWriter remembers the status and size of a response and the
+// error the reverse proxy answered with, if any.
+type LoggedResponseWriter struct {
+    http.ResponseWriter
+    Status_ int
+    Size_   int64
+    Err_    error
+}
+
+func (self *LoggedResponseWriter) WriteHeader(status int) {
+    // informational responses come before the final one
+    if self.Status_ == 0 && status >= 200 {
+        self.Status_ = status
+    }
+    self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *LoggedResponseWriter) Write(b []byte) (int, error) {
+    if self.Status_ == 0 {
+        self.Status_ = http.StatusOK
+    }
+    n, err := self.ResponseWriter.Write(b)
+    self.Size_ += int64(n)
+    return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection.
+func (self *LoggedResponseWriter) Unwrap() http.ResponseWriter {
+    return self.ResponseWriter
+}
+
+type CountedReadCloser struct {
+    io.ReadCloser
+    Size_ int64
+}
+
+func (self *CountedReadCloser) Read(b []byte) (int, error) {
+    n, err := self.ReadCloser.Read(b)
+    self.Size_ += int64(n)
+    return n, err
+}
+
+func IsTimeout(err error) bool {
+    netErr, ok := err.(net.Error)
+    return ok && netErr.Timeout()
+}
+
+// ConnListener hands one connection to an http.Server and ends its Serve
+// once the connection is closed, hijacked ones included.
+type ConnListener struct {
+    Conn_     net.Conn
+    Mutex_    sync.Mutex
+    Accepted_ bool
+    Done_     chan struct{}
+    Once_     sync.Once
+}
+
+func NewConnListener(conn net.Conn) *ConnListener {
+    return &ConnListener{Conn_: conn, Done_: make(chan struct{})}
+}
+
+func (self *ConnListener) Accept() (net.Conn, error) {
+    self.Mutex_.Lock()
+    accepted := self.Accepted_
+    self.Accepted_ = true
+    self.Mutex_.Unlock()
+
+    if !accepted {
+        return &ListenedConn{Conn: self.Conn_, Listener_: self}, nil
+    }
+    <-self.Done_
+    return nil, net.ErrClosed
+}
+
+func (self *ConnListener) Close() error {
+    self.Once_.Do(func() { close(self.Done_) })
+    return nil
+}
+
+func (self *ConnListener) Addr() net.Addr {
+    return self.Conn_.LocalAddr()
+}
+
+type ListenedConn struct {
+    net.Conn
+    Listener_ *ConnListener
+}
+
+func (self *ListenedConn) Close() error {
+    err := self.Conn.Close()
+    self.Listener_.Close()
+    return err
+}
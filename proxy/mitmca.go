@@ -0,0 +1,170 @@
+package proxy
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    _MitmCAValidity   = 10 * 365 * 24 * time.Hour
+    _MitmLeafValidity = 365 * 24 * time.Hour
+    // leaf certificates kept before the cache starts over
+    _MitmCacheSize = 1000
+)
+
+// CertAuthority signs the leaf certificates the mitm listeners present to
+// clients, which have to trust its certificate. The leaves are made on the
+// first connection to a host and kept in memory.
+type CertAuthority struct {
+    Cert_   *x509.Certificate
+    Key_    *ecdsa.PrivateKey
+    Mutex_  sync.Mutex
+    Leaves_ map[string]*tls.Certificate
+}
+
+// LoadCertAuthority reads the ca certificate and key, or generates them and
+// writes them to certFile and keyFile if neither exists.
+func LoadCertAuthority(certFile, keyFile string) (*CertAuthority, error) {
+    _, certErr := os.Stat(certFile)
+    _, keyErr := os.Stat(keyFile)
+    if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+        err := GenerateCertAuthority(certFile, keyFile)
+        if err != nil {
+            return nil, err
+        }
+        log.Printf("generated mitm ca %s, clients have to trust it", certFile)
+    }
+
+    pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return nil, fmt.Errorf("mitm ca: %w", err)
+    }
+    key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+    if !ok {
+        return nil, errors.New("mitm ca: the key must be ecdsa")
+    }
+    cert, err := x509.ParseCertificate(pair.Certificate[0])
+    if err != nil {
+        return nil, fmt.Errorf("mitm ca: %w", err)
+    }
+    if !cert.IsCA {
+        return nil, fmt.Errorf("mitm ca: %s is not a ca certificate", certFile)
+    }
+
+    var ca = new(CertAuthority)
+    ca.Cert_ = cert
+    ca.Key_ = key
+    ca.Leaves_ = make(map[string]*tls.Certificate)
+    return ca, nil
+}
+
+func GenerateCertAuthority(certFile, keyFile string) error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+    template := &x509.Certificate{
+        SerialNumber:          RandomSerial(),
+        Subject:               pkix.Name{CommonName: "lambdaproxy mitm ca", Organization: []string{"lambdaproxy"}},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(_MitmCAValidity),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+        MaxPathLenZero:        true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return err
+    }
+
+    err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func RandomSerial() *big.Int {
+    serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    return serial
+}
+
+// Leaf returns the certificate for host, a name or an ip.
+func (self *CertAuthority) Leaf(host string) (*tls.Certificate, error) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if leaf, ok := self.Leaves_[host]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+        return leaf, nil
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    template := &x509.Certificate{
+        SerialNumber: RandomSerial(),
+        Subject:      pkix.Name{CommonName: host},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(_MitmLeafValidity),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        template.IPAddresses = []net.IP{ip}
+    } else {
+        template.DNSNames = []string{host}
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, self.Cert_, &key.PublicKey, self.Key_)
+    if err != nil {
+        return nil, err
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(self.Leaves_) >= _MitmCacheSize {
+        self.Leaves_ = make(map[string]*tls.Certificate)
+    }
+    leaf := &tls.Certificate{
+        Certificate: [][]byte{der, self.Cert_.Raw},
+        PrivateKey:  key,
+        Leaf:        cert,
+    }
+    self.Leaves_[host] = leaf
+    return leaf, nil
+}
+
+// TLSConfig serves the leaf of the name the client asks for, or of host
+// when it sends no server name.
+func (self *CertAuthority) TLSConfig(host string) *tls.Config {
+    return &tls.Config{
+        NextProtos: []string{"http/1.1"},
+        GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+            name := hello.ServerName
+            if name == "" {
+                name = host
+            }
+            return self.Leaf(name)
+        },
+    }
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+const (
+    _PacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// PacServer serves a proxy auto-config file at /proxy.pac and, for WPAD
+// discovery, at /wpad.dat. It is generated on every request so it follows
+// the reloaded rules.
+type PacServer struct {
+    Proxyer_      *Proxyer
+    ProxyHost_    string
+    DefaultRoute_ string
+    Listener_     net.Listener
+    Server_       *http.Server
+}
+
+func NewPacServer(addr string, proxyer *Proxyer, proxyHost string, defaultRoute string) (*PacServer, error) {
+    if defaultRoute != _RouteDirect && defaultRoute != _RouteLambda {
+        return nil, fmt.Errorf("pac default must be %s or %s", _RouteDirect, _RouteLambda)
+    }
+
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    var pac = new(PacServer)
+    pac.Proxyer_ = proxyer
+    pac.ProxyHost_ = proxyHost
+    pac.DefaultRoute_ = defaultRoute
+    pac.Listener_ = ln
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /proxy.pac", pac.HandlePac)
+    mux.HandleFunc("GET /wpad.dat", pac.HandlePac)
+    pac.Server_ = &http.Server{Handler: mux}
+
+    log.Printf("pac listen: %s", ln.Addr().String())
+    return pac, nil
+}
+
+func (self *PacServer) Serve() {
+    err := self.Server_.Serve(self.Listener_)
+    if err != nil && !errors.Is(err, http.ErrServerClosed) {
+        log.Printf("pac server stopped: %v", err)
+    }
+}
+
+func (self *PacServer) Close() error {
+    return self.Server_.Close()
+}
+
+func (self *PacServer) HandlePac(w http.ResponseWriter, r *http.Request) {
+    host := self.ProxyHost_
+    if host == "" {
+        host = r.Host
+        if h, _, err := net.SplitHostPort(r.Host); err == nil {
+            host = h
+        }
+    }
+
+    proxies := PacProxies(self.Proxyer_.Listeners_, host)
+    if proxies == "" {
+        http.Error(w, "no listener a browser can use", http.StatusNotFound)
+        return
+    }
+
+    var rules []*Rule
+    if self.Proxyer_.Rules_ != nil {
+        rules = self.Proxyer_.Rules_.Rules()
+    }
+
+    w.Header().Set("Content-Type", _PacContentType)
+    w.Header().Set("Cache-Control", "no-cache")
+    _, _ = w.Write([]byte(GeneratePac(rules, proxies, self.DefaultRoute_)))
+}
+
+// PacProxies lists the listeners a browser can talk to, in the pac syntax.
+// Browsers can't authenticate to socks proxies, so socks listeners with
+// users are left out.
+func PacProxies(listeners []*ProxyListener, host string) string {
+    // an ipv6 Host header without a port keeps its brackets
+    host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+    var proxies []string
+    for _, listener := range listeners {
+        _, port, err := net.SplitHostPort(listener.Server_.Addr().String())
+        if err != nil {
+            continue
+        }
+        addr := net.JoinHostPort(host, port)
+        auth := listener.Authenticator_ != nil || listener.Users_ != nil
+
+        switch {
+        case listener.Node_.Protocol == "" || listener.Node_.Protocol == "http":
+            switch listener.Node_.Transport {
+            case "tcp":
+                proxies = append(proxies, "PROXY "+addr)
+            case "tls":
+                proxies = append(proxies, "HTTPS "+addr)
+            }
+        case listener.Node_.Protocol == "socks5" && listener.Node_.Transport == "tcp" && !auth:
+            proxies = append(proxies, "SOCKS5 "+addr, "SOCKS "+addr)
+        }
+    }
+    return strings.Join(proxies, "; ")
+}
+
+// GeneratePac turns the routing rules into FindProxyForURL. cidr conditions
+// only match hosts given as an address. A rule the browser can't decide, with
+// a user or ipv6 cidr condition, sends what it may match to the proxy, which
+// applies the rule itself, so no later rule is taken in its place. Rejected
+// targets are still sent to the proxy, which refuses them.
+func GeneratePac(rules []*Rule, proxies string, defaultRoute string) string {
+    var b strings.Builder
+    b.WriteString("// generated by lambdaproxy\n")
+    b.WriteString("function FindProxyForURL(url, host) {\n")
+    b.WriteString("    var port = PacPort(url);\n")
+    b.WriteString("    var isIp = /^[0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+$/.test(host);\n")
+    b.WriteString("    var isIp6 = host.indexOf(\":\") >= 0;\n")
+    b.WriteString("    host = host.toLowerCase();\n")
+
+    for _, rule := range rules {
+        conditions, exact := PacConditions(rule)
+        if !exact {
+            fmt.Fprintf(&b, "    if (%s) return PROXY_LIST; // %s, decided by the proxy\n", conditions, rule)
+            continue
+        }
+        result := "PROXY_LIST"
+        if rule.Route_ == _RouteDirect {
+            result = "\"DIRECT\""
+        }
+        fmt.Fprintf(&b, "    if (%s) return %s; // %s\n", conditions, result, rule)
+    }
+
+    if defaultRoute == _RouteDirect {
+        b.WriteString("    return \"DIRECT\";\n")
+    } else {
+        b.WriteString("    return PROXY_LIST;\n")
+    }
+    b.WriteString("}\n\n")
+
+    fmt.Fprintf(&b, "var PROXY_LIST = %s;\n\n", strconv.Quote(proxies))
+    b.WriteString("function PacPort(url) {\n")
+    b.WriteString("    var m = url.match(/^([a-z0-9+.-]+):\\/\\/(\\[[^\\]]*\\]|[^\\/:?#]*)(:([0-9]+))?/i);\n")
+    b.WriteString("    if (m && m[4]) return parseInt(m[4], 10);\n")
+    b.WriteString("    if (m && (m[1].toLowerCase() == \"https\" || m[1].toLowerCase() == \"wss\")) return 443;\n")
+    b.WriteString("    return 80;\n")
+    b.WriteString("}\n")
+    return b.String()
+}
+
+// PacConditions writes the conditions of rule in javascript and tells
+// whether they are exact. Those the browser can't check are left out or
+// widened, so the result matches at least what the rule matches.
+func PacConditions(rule *Rule) (string, bool) {
+    exact := true
+    var conditions []string
+    for _, matcher := range rule.Matchers_ {
+        switch matcher.Kind_ {
+        case "suffix":
+            conditions = append(conditions, fmt.Sprintf("(host == %s || dnsDomainIs(host, %s))",
+                strconv.Quote(matcher.Value_), strconv.Quote("."+matcher.Value_)))
+        case "wildcard":
+            conditions = append(conditions, fmt.Sprintf("shExpMatch(host, %s)", strconv.Quote(matcher.Value_)))
+        case "cidr":
+            // isInNet only takes ipv4
+            if matcher.Net_.IP.To4() == nil {
+                conditions = append(conditions, "isIp6")
+                exact = false
+                continue
+            }
+            conditions = append(conditions, fmt.Sprintf("(isIp && isInNet(host, %s, %s))",
+                strconv.Quote(matcher.Net_.IP.String()), strconv.Quote(net.IP(matcher.Net_.Mask).String())))
+        case "port":
+            conditions = append(conditions, fmt.Sprintf("(port >= %d && port <= %d)", matcher.PortMin_, matcher.PortMax_))
+        default:
+            exact = false
+        }
+    }
+    if len(conditions) == 0 {
+        return "true", exact
+    }
+    return strings.Join(conditions, " && "), exact
+}
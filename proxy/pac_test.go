@@ -0,0 +1,80 @@
+package proxy
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestGeneratePac(t *testing.T) {
+    rules, err := ParseRules(strings.NewReader(`
+reject user:guest
+direct cidr:2001:db8::/32
+direct suffix:corp.example.com port:443
+lambda:eu-west-1 wildcard:*.bbc.co.uk
+direct cidr:10.0.0.0/8
+direct user:alice suffix:example.org
+reject port:25
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    pac := GeneratePac(rules, "PROXY proxy:8080", _RouteDirect)
+
+    // one line per rule in order, so first match holds in the browser
+    want := []string{
+        `if (true) return PROXY_LIST; // rule 2, decided by the proxy`,
+        `if (isIp6) return PROXY_LIST; // rule 3, decided by the proxy`,
+        `if ((host == "corp.example.com" || dnsDomainIs(host, ".corp.example.com")) && (port >= 443 && port <= 443)) return "DIRECT"; // rule 4`,
+        `if (shExpMatch(host, "*.bbc.co.uk")) return PROXY_LIST; // rule 5`,
+        `if ((isIp && isInNet(host, "10.0.0.0", "255.0.0.0"))) return "DIRECT"; // rule 6`,
+        `if ((host == "example.org" || dnsDomainIs(host, ".example.org"))) return PROXY_LIST; // rule 7, decided by the proxy`,
+        `if ((port >= 25 && port <= 25)) return PROXY_LIST; // rule 8`,
+        `return "DIRECT";`,
+    }
+    var got []string
+    for _, line := range strings.Split(pac, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "if (") && strings.Contains(line, "// rule") || line == `return "DIRECT";` || line == "return PROXY_LIST;" {
+            got = append(got, line)
+        }
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Errorf("rules written as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+    }
+    if !strings.Contains(pac, `var PROXY_LIST = "PROXY proxy:8080";`) {
+        t.Error("proxy list missing")
+    }
+
+    if pac = GeneratePac(nil, "PROXY proxy:8080", _RouteLambda); !strings.Contains(pac, "    return PROXY_LIST;\n}") {
+        t.Errorf("lambda default not applied:\n%s", pac)
+    }
+}
+
+func TestPacProxies(t *testing.T) {
+    proxyer := &Proxyer{}
+    var listeners []*ProxyListener
+    for _, listenerUrl := range []string{"http://127.0.0.1:0", "socks5://127.0.0.1:0", "socks5://u:p@127.0.0.1:0", "ss://aes-128-cfb:p@127.0.0.1:0"} {
+        listener, err := NewProxyListener(listenerUrl, proxyer, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer listener.Close()
+        listeners = append(listeners, listener)
+    }
+    port := func(i int) string {
+        addr := listeners[i].Server_.Addr().String()
+        return addr[strings.LastIndex(addr, ":")+1:]
+    }
+
+    tests := map[string]string{
+        "proxy.example.com": "proxy.example.com",
+        "2001:db8::1":       "[2001:db8::1]",
+        "[2001:db8::1]":     "[2001:db8::1]",
+    }
+    for host, addr := range tests {
+        want := "PROXY " + addr + ":" + port(0) + "; SOCKS5 " + addr + ":" + port(1) + "; SOCKS " + addr + ":" + port(1)
+        if got := PacProxies(listeners, host); got != want {
+            t.Errorf("%s: got %q, want %q", host, got, want)
+        }
+    }
+}
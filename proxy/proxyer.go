@@ -0,0 +1,226 @@
+// Package proxy serves the client facing proxy listeners and routes their
+// connections direct or through the tunnel, with users, usage accounting,
+// routing rules and the access log.
+package proxy
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/tunnel"
+)
+
+type Proxyer struct {
+    ListenerUrls_   []string
+    Tunnel_         *tunnel.Tunnel
+    Users_          *UserDB
+    Usage_          *UsageDB
+    AccessLog_      *AccessLog
+    Rules_          *RuleSet
+    Listeners_      []*ProxyListener
+    Mutex_          sync.Mutex
+    LastReqTime_    time.Time
+    CheckFailCount_ int
+    ActiveSessions_ int64
+    SessionsWait_   sync.WaitGroup
+}
+
+// NewProxyer starts the listeners. users is the database for listeners that
+// don't carry their own credentials, nil leaves those open. Every tunneled
+// byte is accounted in usage, and finished sessions go to accessLog if set.
+// Without rules everything goes through lambda.
+func NewProxyer(listenerUrls []string, tunnel *tunnel.Tunnel, users *UserDB, usage *UsageDB, accessLog *AccessLog, rules *RuleSet) (*Proxyer, error) {
+    var proxy = new(Proxyer)
+    proxy.ListenerUrls_ = listenerUrls
+    proxy.Tunnel_ = tunnel
+    proxy.Users_ = users
+    proxy.Usage_ = usage
+    proxy.AccessLog_ = accessLog
+    proxy.Rules_ = rules
+
+    err := proxy.RunProxy()
+    if err != nil {
+        proxy.Close()
+        return nil, fmt.Errorf("proxy.RunProxy: %+v", err)
+    }
+
+    return proxy, nil
+}
+
+// IOCopy pipes src and dst until both sides are done and returns the bytes
+// copied from src to dst and back.
+func (self *Proxyer) IOCopy(src io.ReadWriteCloser, dst io.ReadWriteCloser) (int64, int64) {
+    defer dst.Close()
+    defer src.Close()
+
+    var up, down int64
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        up, _ = io.Copy(dst, src)
+        dst.Close()
+        wg.Done()
+    }()
+
+    wg.Add(1)
+    go func() {
+        down, _ = io.Copy(src, dst)
+        src.Close()
+        wg.Done()
+    }()
+    wg.Wait()
+
+    return up, down
+}
+
+// MarkRequest keeps the tunnel running while clients use it and lets it
+// stop after a few idle intervals.
+func (self *Proxyer) MarkRequest() {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if !self.Tunnel_.Running_.Load() {
+        self.Tunnel_.Running_.Store(true)
+        self.CheckFailCount_ = 0
+    }
+    if time.Now().Sub(self.LastReqTime_) >= time.Second*time.Duration(self.Tunnel_.ConnTimeoutS_-5) {
+        self.CheckFailCount_++
+        if self.CheckFailCount_ > 3 {
+            self.Tunnel_.Running_.Store(false)
+            log.Printf("Stop tunnel after %d idle checks...", self.CheckFailCount_)
+            self.CheckFailCount_ = 0
+        }
+    } else {
+        self.Tunnel_.Running_.Store(true)
+        self.CheckFailCount_ = 0
+    }
+
+    self.LastReqTime_ = time.Now()
+}
+
+// Route picks how the session reaches address and the regions a lambda
+// route may use. A rule pinning a region the user is not allowed fails.
+func (self *Proxyer) Route(session *ProxySession, address string) (string, []string, error) {
+    regions := session.Regions()
+    if self.Rules_ == nil {
+        return _RouteLambda, regions, nil
+    }
+
+    rule := self.Rules_.Match(address, session.UserName())
+    if rule == nil {
+        return _RouteLambda, regions, nil
+    }
+    switch rule.Route_ {
+    case _RouteReject:
+        return rule.Route_, nil, fmt.Errorf("rejected by %s", rule)
+    case _RouteDirect:
+        return rule.Route_, nil, nil
+    }
+    if rule.Region_ == "" {
+        return rule.Route_, regions, nil
+    }
+    if !tunnel.InRegions(rule.Region_, regions) {
+        return rule.Route_, nil, fmt.Errorf("%s: region %s not allowed for user %s", rule, rule.Region_, session.UserName())
+    }
+    return rule.Route_, []string{rule.Region_}, nil
+}
+
+func (self *Proxyer) OpenStream(ctx context.Context, session *ProxySession, regions []string) (net.Conn, error) {
+    self.MarkRequest()
+
+    stream, conn, err := self.Tunnel_.GetStream(ctx, regions)
+    if err != nil {
+        log.Printf("session %d user=%s: unable to open tunnel stream: %+v", session.Id_, session.UserName(), err)
+        return nil, err
+    }
+    log.Printf("session %d user=%s via tunnel %d region=%s", session.Id_, session.UserName(), conn.Id_, conn.Region_)
+    session.SetTunnel(conn)
+    return stream, nil
+}
+
+// NewSessionChain routes one session to the lambda tunnel. The chain opens
+// a tunnel stream with a header naming the target, the agent just dials it,
+// and the connection it returns is metered for the session.
+func (self *Proxyer) NewSessionChain(session *ProxySession) *gost.Chain {
+    node := gost.Node{
+        ID:   1,
+        Addr: "lambda",
+        Host: "lambda",
+        Client: &gost.Client{
+            Connector: &SessionConnector{
+                Connector_: tunnel.StreamConnector(self.Tunnel_.AgentMode_),
+                Proxyer_:   self,
+                Session_:   session,
+            },
+            Transporter: &TunnelTransporter{Session_: session},
+        },
+    }
+
+    chain := gost.NewChain(node)
+    chain.Retries = 0
+    return chain
+}
+
+// Serve tracks the session so shutdown can wait for it to drain.
+func (self *Proxyer) Serve(session *ProxySession, handle func()) {
+    self.SessionsWait_.Add(1)
+    atomic.AddInt64(&self.ActiveSessions_, 1)
+    defer self.SessionsWait_.Done()
+    defer atomic.AddInt64(&self.ActiveSessions_, -1)
+
+    handle()
+}
+
+func (self *Proxyer) RunProxy() error {
+    for _, listenerUrl := range self.ListenerUrls_ {
+        listener, err := NewProxyListener(listenerUrl, self, self.Users_)
+        if err != nil {
+            return err
+        }
+        self.Listeners_ = append(self.Listeners_, listener)
+    }
+
+    for _, listener := range self.Listeners_ {
+        go listener.Serve()
+    }
+
+    return nil
+}
+
+func (self *Proxyer) CloseListeners() {
+    for _, listener := range self.Listeners_ {
+        listener.Close()
+    }
+}
+
+func (self *Proxyer) Close() {
+    self.CloseListeners()
+}
+
+// Shutdown stops accepting proxy clients and waits up to timeout for the
+// active sessions to finish. Sessions still open afterwards are cut when the
+// tunnel sessions close.
+func (self *Proxyer) Shutdown(timeout time.Duration) {
+    self.CloseListeners()
+
+    drained := make(chan struct{})
+    go func() {
+        self.SessionsWait_.Wait()
+        close(drained)
+    }()
+
+    log.Printf("draining %d active sessions", atomic.LoadInt64(&self.ActiveSessions_))
+    select {
+    case <-drained:
+        log.Println("all sessions drained")
+    case <-time.After(timeout):
+        log.Printf("%d sessions still active after %v", atomic.LoadInt64(&self.ActiveSessions_), timeout)
+    }
+}
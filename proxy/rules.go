@@ -0,0 +1,242 @@
+package proxy
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ginuerzh/gost"
+)
+
+const (
+    _RulesReloadPeriod = 5 * time.Second
+
+    _RouteLambda = "lambda"
+    _RouteDirect = "direct"
+    _RouteReject = "reject"
+)
+
+// RuleMatcher is one condition of a rule, all conditions of a rule must
+// match.
+type RuleMatcher struct {
+    Kind_    string
+    Value_   string
+    Net_     *net.IPNet
+    PortMin_ int
+    PortMax_ int
+}
+
+func ParseRuleMatcher(field string) (*RuleMatcher, error) {
+    kind, value, ok := strings.Cut(field, ":")
+    if !ok || value == "" {
+        return nil, fmt.Errorf("bad condition %q", field)
+    }
+
+    matcher := &RuleMatcher{Kind_: kind, Value_: strings.ToLower(value)}
+    switch kind {
+    case "suffix", "domain":
+        matcher.Kind_ = "suffix"
+        matcher.Value_ = strings.TrimPrefix(matcher.Value_, ".")
+    case "wildcard":
+        if _, err := path.Match(matcher.Value_, ""); err != nil {
+            return nil, fmt.Errorf("bad wildcard %q", value)
+        }
+    case "cidr":
+        if !strings.Contains(value, "/") {
+            if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+                value += "/32"
+            } else {
+                value += "/128"
+            }
+        }
+        _, ipNet, err := net.ParseCIDR(value)
+        if err != nil {
+            return nil, fmt.Errorf("bad cidr %q", value)
+        }
+        matcher.Net_ = ipNet
+    case "port":
+        min, max, isRange := strings.Cut(value, "-")
+        if !isRange {
+            max = min
+        }
+        var err error
+        matcher.PortMin_, err = strconv.Atoi(min)
+        if err == nil {
+            matcher.PortMax_, err = strconv.Atoi(max)
+        }
+        if err != nil || matcher.PortMin_ > matcher.PortMax_ {
+            return nil, fmt.Errorf("bad port %q", value)
+        }
+    case "user":
+        matcher.Value_ = value
+    default:
+        return nil, fmt.Errorf("unknown condition %q", kind)
+    }
+    return matcher, nil
+}
+
+func (self *RuleMatcher) Match(host string, port int, user string) bool {
+    switch self.Kind_ {
+    case "suffix":
+        return host == self.Value_ || strings.HasSuffix(host, "."+self.Value_)
+    case "wildcard":
+        ok, _ := path.Match(self.Value_, host)
+        return ok
+    case "cidr":
+        ip := net.ParseIP(host)
+        return ip != nil && self.Net_.Contains(ip)
+    case "port":
+        return port >= self.PortMin_ && port <= self.PortMax_
+    case "user":
+        return user == self.Value_
+    }
+    return false
+}
+
+// Rule sends the connections matching all of its conditions to Route_, the
+// lambda route may be pinned to Region_.
+type Rule struct {
+    Line_     int
+    Route_    string
+    Region_   string
+    Matchers_ []*RuleMatcher
+}
+
+func (self *Rule) Match(host string, port int, user string) bool {
+    for _, matcher := range self.Matchers_ {
+        if !matcher.Match(host, port, user) {
+            return false
+        }
+    }
+    return true
+}
+
+func (self *Rule) String() string {
+    return fmt.Sprintf("rule %d", self.Line_)
+}
+
+// ParseRules reads one rule per line, "#" starts a comment:
+//   direct   suffix:corp.example.com
+//   direct   cidr:10.0.0.0/8
+//   lambda:eu-west-1 wildcard:*.bbc.co.uk
+//   reject   port:25 user:guest
+//   lambda
+func ParseRules(r io.Reader) ([]*Rule, error) {
+    var rules []*Rule
+    scanner := bufio.NewScanner(r)
+    line := 0
+    for scanner.Scan() {
+        line++
+        text, _, _ := strings.Cut(scanner.Text(), "#")
+        fields := strings.Fields(text)
+        if len(fields) == 0 {
+            continue
+        }
+
+        rule := &Rule{Line_: line}
+        route, region, _ := strings.Cut(fields[0], ":")
+        switch route {
+        case _RouteLambda:
+            rule.Route_, rule.Region_ = route, region
+        case _RouteDirect, _RouteReject:
+            if region != "" {
+                return nil, fmt.Errorf("line %d: %s takes no region", line, route)
+            }
+            rule.Route_ = route
+        default:
+            return nil, fmt.Errorf("line %d: unknown route %q", line, fields[0])
+        }
+
+        for _, field := range fields[1:] {
+            matcher, err := ParseRuleMatcher(field)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %v", line, err)
+            }
+            rule.Matchers_ = append(rule.Matchers_, matcher)
+        }
+        rules = append(rules, rule)
+    }
+    return rules, scanner.Err()
+}
+
+// RuleSet decides per connection whether to go through lambda, straight
+// from the server or nowhere. The first matching rule wins, no match goes
+// through lambda. It is a gost.Reloader like the users file.
+type RuleSet struct {
+    Path_  string
+    Mutex_ sync.RWMutex
+    Rules_ []*Rule
+}
+
+func NewRuleSet(path string) (*RuleSet, error) {
+    var ruleSet = new(RuleSet)
+    ruleSet.Path_ = path
+
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("cannot open rules file: %w", err)
+    }
+    defer f.Close()
+
+    err = ruleSet.Reload(f)
+    if err != nil {
+        return nil, err
+    }
+    go gost.PeriodReload(ruleSet, path)
+
+    return ruleSet, nil
+}
+
+func (self *RuleSet) Reload(r io.Reader) error {
+    rules, err := ParseRules(r)
+    if err != nil {
+        return fmt.Errorf("cannot parse rules file %s: %w", self.Path_, err)
+    }
+
+    self.Mutex_.Lock()
+    self.Rules_ = rules
+    self.Mutex_.Unlock()
+
+    log.Printf("loaded %d rules from %s", len(rules), self.Path_)
+    return nil
+}
+
+func (self *RuleSet) Period() time.Duration {
+    return _RulesReloadPeriod
+}
+
+func (self *RuleSet) Rules() []*Rule {
+    self.Mutex_.RLock()
+    defer self.Mutex_.RUnlock()
+    return self.Rules_
+}
+
+// Match returns the rule for a host:port target, nil when none matches.
+func (self *RuleSet) Match(address string, user string) *Rule {
+    host, port := SplitTarget(address)
+    for _, rule := range self.Rules() {
+        if rule.Match(host, port, user) {
+            return rule
+        }
+    }
+    return nil
+}
+
+// SplitTarget splits a host:port target the way the rules match it, the
+// host lowercased without a trailing dot.
+func SplitTarget(address string) (string, int) {
+    host, sport, err := net.SplitHostPort(address)
+    if err != nil {
+        host = address
+    }
+    port, _ := strconv.Atoi(sport)
+    return strings.ToLower(strings.TrimSuffix(host, ".")), port
+}
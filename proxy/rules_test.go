@@ -0,0 +1,116 @@
+package proxy
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestParseRules(t *testing.T) {
+    rules, err := ParseRules(strings.NewReader(`
+# comment
+direct   suffix:corp.example.com   # trailing comment
+lambda:eu-west-1 wildcard:*.bbc.co.uk port:443
+reject   port:25 user:guest
+
+lambda
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rules) != 4 {
+        t.Fatalf("%d rules", len(rules))
+    }
+    want := []struct {
+        Line     int
+        Route    string
+        Region   string
+        Matchers int
+    }{
+        {3, _RouteDirect, "", 1},
+        {4, _RouteLambda, "eu-west-1", 2},
+        {5, _RouteReject, "", 2},
+        {7, _RouteLambda, "", 0},
+    }
+    for i, w := range want {
+        rule := rules[i]
+        if rule.Line_ != w.Line || rule.Route_ != w.Route || rule.Region_ != w.Region || len(rule.Matchers_) != w.Matchers {
+            t.Errorf("rule %d: %+v, want %+v", i, *rule, w)
+        }
+    }
+
+    bad := []string{
+        "proxy suffix:example.com",
+        "direct:eu-west-1",
+        "reject:us-east-1 port:25",
+        "direct suffix:",
+        "direct host:example.com",
+        "direct wildcard:[a",
+        "direct cidr:10.0.0.0/33",
+        "direct cidr:example.com",
+        "reject port:http",
+        "reject port:443-80",
+        "direct example.com",
+    }
+    for _, text := range bad {
+        if _, err := ParseRules(strings.NewReader(text)); err == nil {
+            t.Errorf("%q accepted", text)
+        }
+    }
+}
+
+func TestRuleSetMatch(t *testing.T) {
+    ruleSet := new(RuleSet)
+    err := ruleSet.Reload(strings.NewReader(`
+reject port:25
+reject user:guest port:1-1023
+direct suffix:.Corp.Example.com
+direct cidr:10.0.0.0/8
+direct cidr:2001:db8::1
+lambda:eu-west-1 wildcard:*.bbc.co.uk
+direct port:8000-8999
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        Address string
+        User    string
+        Line    int
+    }{
+        {"mail.example.com:25", "", 2},
+        {"corp.example.com:25", "", 2},
+        {"example.com:22", "guest", 3},
+        {"example.com:8022", "guest", 8},
+        {"corp.example.com:443", "", 4},
+        {"WWW.Corp.Example.COM.:443", "alice", 4},
+        {"notcorp.example.com:443", "", 0},
+        {"10.1.2.3:443", "", 5},
+        {"11.1.2.3:443", "", 0},
+        {"[2001:db8::1]:443", "", 6},
+        {"[2001:db8::2]:443", "", 0},
+        {"www.bbc.co.uk:443", "", 7},
+        {"bbc.co.uk:443", "", 0},
+        {"example.com:8080", "", 8},
+        {"example.com:9000", "", 0},
+        {"example.com", "", 0},
+    }
+    for _, test := range tests {
+        rule := ruleSet.Match(test.Address, test.User)
+        line := 0
+        if rule != nil {
+            line = rule.Line_
+        }
+        if line != test.Line {
+            t.Errorf("%s user %q: matched line %d, want %d", test.Address, test.User, line, test.Line)
+        }
+    }
+
+    // a failed reload keeps the rules loaded before
+    if err = ruleSet.Reload(strings.NewReader("bogus")); err == nil {
+        t.Error("bad rules file reloaded")
+    }
+    if len(ruleSet.Rules()) != 7 {
+        t.Errorf("%d rules after a failed reload", len(ruleSet.Rules()))
+    }
+}
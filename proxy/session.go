@@ -0,0 +1,329 @@
+package proxy
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/tunnel"
+    "lambdaproxy/wire"
+)
+
+// ProxySession is one client connection accepted by a proxy listener, from
+// authentication until the client disconnects.
+type ProxySession struct {
+    Id_       uint64
+    Client_   string
+    Listener_ *ProxyListener
+    Mutex_    sync.Mutex
+    User_     *User
+    Target_   string
+    Protocol_ string
+    Route_    string
+    Start_    time.Time
+    Released_ bool
+    Tunnel_   *tunnel.TunnelConnection
+    Meter_    *MeteredConn
+    Reason_   string
+    Denied_   bool
+}
+
+const (
+    _DirectDialTimeout = 10 * time.Second
+)
+
+var __SessionNum uint64
+
+func NewProxySession(listener *ProxyListener, conn net.Conn) *ProxySession {
+    return &ProxySession{
+        Id_:       atomic.AddUint64(&__SessionNum, 1),
+        Client_:   conn.RemoteAddr().String(),
+        Listener_: listener,
+        Start_:    time.Now(),
+    }
+}
+
+func (self *ProxySession) User() *User {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    return self.User_
+}
+
+// Regions the session may be tunneled through, nil for any.
+func (self *ProxySession) Regions() []string {
+    if user := self.User(); user != nil {
+        return user.Regions_
+    }
+    return nil
+}
+
+func (self *ProxySession) UserName() string {
+    if user := self.User(); user != nil {
+        return user.Name_
+    }
+    return ""
+}
+
+// PlainHttp tells whether the client sends plain http requests through an
+// http listener, which the agent filters the headers of.
+func (self *ProxySession) PlainHttp() bool {
+    protocol := self.Listener_.Node_.Protocol
+    return self.Protocol_ == "HTTP" && (protocol == "" || protocol == "http")
+}
+
+func (self *ProxySession) SetTarget(target string) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    self.Target_ = target
+}
+
+func (self *ProxySession) Target() string {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    return self.Target_
+}
+
+func (self *ProxySession) SetRoute(route string) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    self.Route_ = route
+}
+
+func (self *ProxySession) SetTunnel(conn *tunnel.TunnelConnection) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    self.Tunnel_ = conn
+}
+
+func (self *ProxySession) SetMeter(meter *MeteredConn) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    self.Meter_ = meter
+}
+
+// SetReason records why the session ended, the first reason wins.
+func (self *ProxySession) SetReason(reason string) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    if self.Reason_ == "" {
+        self.Reason_ = reason
+    }
+}
+
+// SetDenied records that the rules or the agent's egress policy refused the
+// target, which the handlers answer with 403 or the socks "not allowed"
+// reply rather than as a failed dial.
+func (self *ProxySession) SetDenied(reason string) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    self.Denied_ = true
+    if self.Reason_ == "" {
+        self.Reason_ = reason
+    }
+}
+
+func (self *ProxySession) Denied() bool {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    return self.Denied_
+}
+
+// AccessEntry describes the finished session for the access log.
+func (self *ProxySession) AccessEntry(end time.Time) *AccessEntry {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    entry := &AccessEntry{
+        Time:       self.Start_.UTC().Format(time.RFC3339Nano),
+        Session:    self.Id_,
+        Client:     self.Client_,
+        Listener:   self.Listener_.Node_.Addr,
+        Protocol:   self.Protocol_,
+        Target:     self.Target_,
+        Route:      self.Route_,
+        DurationMs: end.Sub(self.Start_).Milliseconds(),
+        Reason:     self.Reason_,
+    }
+    if self.User_ != nil {
+        entry.User = self.User_.Name_
+    }
+    if self.Tunnel_ != nil {
+        entry.Tunnel = self.Tunnel_.Id_
+        entry.Region = self.Tunnel_.Region_
+        entry.ExitIP = self.Tunnel_.ExitIP_
+    }
+    if self.Meter_ != nil {
+        entry.BytesUp = atomic.LoadInt64(&self.Meter_.Up_)
+        entry.BytesDown = atomic.LoadInt64(&self.Meter_.Down_)
+    }
+    if entry.Reason == "" {
+        switch {
+        case self.Meter_ != nil:
+            entry.Reason = "closed"
+        case self.Target_ == "":
+            entry.Reason = "no request"
+        default:
+            entry.Reason = "failed"
+        }
+    }
+    return entry
+}
+
+// Close gives back the connection slot taken on authentication.
+func (self *ProxySession) Close() {
+    self.Mutex_.Lock()
+    user := self.User_
+    released := self.Released_
+    self.Released_ = true
+    self.Mutex_.Unlock()
+
+    if user != nil && !released {
+        self.Listener_.Users_.Release(user)
+    }
+}
+
+// SessionAuthenticator checks the credentials against the users database
+// and binds the user to the session, taking one of its connection slots.
+// Users over their monthly quota are refused.
+type SessionAuthenticator struct {
+    Session_ *ProxySession
+    Users_   *UserDB
+    Usage_   *UsageDB
+}
+
+func (self *SessionAuthenticator) Authenticate(name, password string) bool {
+    if !self.Users_.Authenticate(name, password) {
+        self.Session_.SetReason("auth failed")
+        return false
+    }
+    user := self.Users_.Get(name)
+    if user == nil {
+        self.Session_.SetReason("auth failed")
+        return false
+    }
+    if self.Usage_.OverQuota(user) {
+        log.Printf("session %d user=%s: %v", self.Session_.Id_, name, ErrQuotaExceeded)
+        self.Session_.SetReason(ErrQuotaExceeded.Error())
+        return false
+    }
+
+    session := self.Session_
+    session.Mutex_.Lock()
+    defer session.Mutex_.Unlock()
+
+    if session.User_ != nil {
+        return session.User_.Name_ == user.Name_
+    }
+    if !self.Users_.Acquire(user) {
+        session.Reason_ = "max conns"
+        return false
+    }
+    session.User_ = user
+    return true
+}
+
+// TunnelTransporter stands in for the tcp dial of the gost chain. The
+// stream is only opened by SessionConnector once the target is known.
+type TunnelTransporter struct {
+    Session_ *ProxySession
+}
+
+func (self *TunnelTransporter) Dial(addr string, options ...gost.DialOption) (net.Conn, error) {
+    return &PendingStream{Session_: self.Session_}, nil
+}
+
+func (self *TunnelTransporter) Handshake(conn net.Conn, options ...gost.HandshakeOption) (net.Conn, error) {
+    return conn, nil
+}
+
+func (self *TunnelTransporter) Multiplex() bool {
+    return false
+}
+
+// PendingStream is the placeholder connection TunnelTransporter returns,
+// nothing is sent over it.
+type PendingStream struct {
+    Session_ *ProxySession
+}
+
+func (self *PendingStream) Read(b []byte) (int, error)         { return 0, net.ErrClosed }
+func (self *PendingStream) Write(b []byte) (int, error)        { return 0, net.ErrClosed }
+func (self *PendingStream) Close() error                       { return nil }
+func (self *PendingStream) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (self *PendingStream) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (self *PendingStream) SetDeadline(t time.Time) error      { return nil }
+func (self *PendingStream) SetReadDeadline(t time.Time) error  { return nil }
+func (self *PendingStream) SetWriteDeadline(t time.Time) error { return nil }
+
+// SessionConnector records the target the client asked for, routes it by
+// the rules and meters the connection, either dialed from the server or
+// returned by the agent over a tunnel stream.
+type SessionConnector struct {
+    Connector_ gost.Connector
+    Proxyer_   *Proxyer
+    Session_   *ProxySession
+}
+
+func (self *SessionConnector) Connect(conn net.Conn, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    return self.ConnectContext(context.Background(), conn, "tcp", address, options...)
+}
+
+func (self *SessionConnector) ConnectContext(ctx context.Context, conn net.Conn, network, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    self.Session_.SetTarget(address)
+
+    route, regions, err := self.Proxyer_.Route(self.Session_, address)
+    self.Session_.SetRoute(route)
+    if err != nil {
+        if route == _RouteReject {
+            self.Session_.SetDenied(err.Error())
+        }
+        self.Session_.SetReason(err.Error())
+        return nil, err
+    }
+
+    if route == _RouteDirect {
+        dialer := &net.Dialer{Timeout: _DirectDialTimeout}
+        cc, err := dialer.DialContext(ctx, network, address)
+        if err != nil {
+            self.Session_.SetReason("direct: " + err.Error())
+            return nil, err
+        }
+        meter := NewMeteredConn(cc, self.Session_, self.Proxyer_.Usage_)
+        self.Session_.SetMeter(meter)
+        return meter, nil
+    }
+
+    stream, err := self.Proxyer_.OpenStream(ctx, self.Session_, regions)
+    if err != nil {
+        self.Session_.SetReason("tunnel: " + err.Error())
+        return nil, err
+    }
+
+    connector := self.Connector_
+    if dial, ok := connector.(*tunnel.DialConnector); ok {
+        // the user is only known once the handler authenticated the client
+        flags := dial.Flags_
+        if self.Session_.PlainHttp() {
+            flags |= wire.FlagHttp
+        }
+        connector = &tunnel.DialConnector{User_: self.Session_.UserName(), Flags_: flags}
+    }
+    cc, err := connector.ConnectContext(ctx, stream, network, address, options...)
+    if err != nil {
+        stream.Close()
+        if errors.Is(err, wire.ErrDialDenied) {
+            self.Session_.SetDenied("denied: " + err.Error())
+        }
+        self.Session_.SetReason("connect: " + err.Error())
+        return nil, err
+    }
+
+    meter := NewMeteredConn(cc, self.Session_, self.Proxyer_.Usage_)
+    self.Session_.SetMeter(meter)
+    return meter, nil
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/ginuerzh/gosocks5"
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/wire"
+)
+
+const (
+    _UdpIdleTimeout = 2 * time.Minute
+)
+
+// Socks5Handler serves socks5 clients in place of the gost handler, which
+// can only relay udp through a chain of socks5 servers. CONNECT goes
+// through the session chain as before, UDP ASSOCIATE gets a tunnel stream
+// of its own the agent relays the datagrams on.
+type Socks5Handler struct {
+    Listener_ *ProxyListener
+    Session_  *ProxySession
+    Options_  *gost.HandlerOptions
+    Selector_ *Socks5Selector
+}
+
+func (self *Socks5Handler) Init(options ...gost.HandlerOption) {
+    self.Options_ = new(gost.HandlerOptions)
+    for _, option := range options {
+        option(self.Options_)
+    }
+
+    self.Selector_ = &Socks5Selector{Authenticator_: self.Options_.Authenticator, TLSConfig_: self.Options_.TLSConfig}
+}
+
+func (self *Socks5Handler) Handle(conn net.Conn) {
+    defer conn.Close()
+
+    conn = gosocks5.ServerConn(conn, self.Selector_)
+    req, err := gosocks5.ReadRequest(conn)
+    if err != nil {
+        return
+    }
+
+    switch req.Cmd {
+    case gosocks5.CmdConnect:
+        self.HandleConnect(conn, req)
+    case gosocks5.CmdUdp:
+        self.HandleUdp(conn, req)
+    default:
+        log.Printf("session %d: socks5 command %d not supported", self.Session_.Id_, req.Cmd)
+        _ = gosocks5.NewReply(gosocks5.CmdUnsupported, nil).Write(conn)
+    }
+}
+
+func (self *Socks5Handler) HandleConnect(conn net.Conn, req *gosocks5.Request) {
+    cc, err := self.Options_.Chain.Dial(req.Addr.String(), gost.TimeoutChainOption(self.Options_.Timeout))
+    if err != nil {
+        reply := gosocks5.HostUnreachable
+        if self.Session_.Denied() {
+            reply = gosocks5.NotAllowed
+        }
+        _ = gosocks5.NewReply(reply, nil).Write(conn)
+        return
+    }
+    err = gosocks5.NewReply(gosocks5.Succeeded, nil).Write(conn)
+    if err != nil {
+        cc.Close()
+        return
+    }
+    self.Listener_.Proxyer_.IOCopy(conn, cc)
+}
+
+// HandleUdp relays the datagrams of the client through one tunnel stream
+// until the client closes the control connection or the association is
+// idle for the udp-idle listener option. Only datagrams from the client
+// host are taken, those the rules reject are dropped, every other one goes
+// through the tunnel whatever the rules route the target.
+func (self *Socks5Handler) HandleUdp(conn net.Conn, req *gosocks5.Request) {
+    session := self.Session_
+    proxyer := self.Listener_.Proxyer_
+    session.SetTarget("udp")
+
+    if !proxyer.Tunnel_.UdpAllowed() {
+        session.SetDenied("udp: " + wire.ErrUdpBypass.Error())
+        _ = gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+        return
+    }
+
+    host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+    relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+    if err != nil {
+        session.SetReason("udp: " + err.Error())
+        _ = gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+        return
+    }
+    defer relay.Close()
+
+    stream, err := proxyer.OpenStream(context.Background(), session, session.Regions())
+    if err != nil {
+        session.SetReason("tunnel: " + err.Error())
+        _ = gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+        return
+    }
+    meter := NewMeteredConn(stream, session, proxyer.Usage_)
+    defer meter.Close()
+
+    reader, err := wire.RequestUdp(meter)
+    if err != nil {
+        session.SetReason("udp: " + err.Error())
+        _ = gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+        return
+    }
+    session.SetMeter(meter)
+
+    bindAddr, err := gosocks5.NewAddr(relay.LocalAddr().String())
+    if err != nil {
+        return
+    }
+    err = gosocks5.NewReply(gosocks5.Succeeded, bindAddr).Write(conn)
+    if err != nil {
+        return
+    }
+
+    timeout := self.Listener_.Node_.GetDuration("udp-idle")
+    if timeout <= 0 {
+        timeout = _UdpIdleTimeout
+    }
+    association := &UdpAssociation{
+        Session_: session,
+        Proxyer_: proxyer,
+        Relay_:   relay,
+        Stream_:  meter,
+        Reader_:  reader,
+        Idle_: time.AfterFunc(timeout, func() {
+            session.SetReason("udp idle")
+            conn.Close()
+        }),
+        Timeout_: timeout,
+    }
+    if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        association.ClientIP_ = addr.IP
+    }
+    defer association.Idle_.Stop()
+
+    go association.Send()
+    go association.Receive()
+
+    // the association lasts as long as the control connection
+    buf := make([]byte, 512)
+    for {
+        _, err = conn.Read(buf)
+        if err != nil {
+            return
+        }
+    }
+}
+
+// UdpAssociation is one UDP ASSOCIATE: the relay socket the client sends
+// its socks5 datagrams to and the tunnel stream carrying them.
+type UdpAssociation struct {
+    Session_  *ProxySession
+    Proxyer_  *Proxyer
+    Relay_    *net.UDPConn
+    Stream_   net.Conn
+    Reader_   *bufio.Reader
+    Idle_     *time.Timer
+    Timeout_  time.Duration
+    ClientIP_ net.IP
+    Mutex_    sync.Mutex
+    Client_   *net.UDPAddr
+}
+
+func (self *UdpAssociation) Client() *net.UDPAddr {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    return self.Client_
+}
+
+// Send unwraps the client datagrams onto the stream. Fragments aren't
+// supported and dropped like the rfc allows.
+func (self *UdpAssociation) Send() {
+    buf := make([]byte, wire.MaxDatagramSize)
+    for {
+        n, from, err := self.Relay_.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        if self.ClientIP_ != nil && !self.ClientIP_.Equal(from.IP) {
+            continue
+        }
+        dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(buf[:n]))
+        if err != nil || dgram.Header.Frag != 0 {
+            continue
+        }
+
+        target := dgram.Header.Addr.String()
+        route, _, err := self.Proxyer_.Route(self.Session_, target)
+        if err != nil || route == _RouteReject {
+            continue
+        }
+
+        self.Mutex_.Lock()
+        self.Client_ = from
+        self.Mutex_.Unlock()
+        self.Idle_.Reset(self.Timeout_)
+        self.Proxyer_.MarkRequest()
+
+        err = wire.WriteDatagram(self.Stream_, target, dgram.Data)
+        if err != nil {
+            return
+        }
+    }
+}
+
+// Receive wraps the datagrams the agent relays back for the client.
+func (self *UdpAssociation) Receive() {
+    for {
+        from, data, err := wire.ReadDatagram(self.Reader_)
+        if err != nil {
+            return
+        }
+        client := self.Client()
+        addr, err := gosocks5.NewAddr(from)
+        if client == nil || err != nil {
+            continue
+        }
+        self.Idle_.Reset(self.Timeout_)
+
+        var buf bytes.Buffer
+        dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, addr), data)
+        err = dgram.Write(&buf)
+        if err != nil {
+            continue
+        }
+        _, err = self.Relay_.WriteToUDP(buf.Bytes(), client)
+        if err != nil {
+            return
+        }
+    }
+}
+
+// Socks5Selector negotiates the socks5 methods like the gost server does
+// and checks the credentials with Authenticator_. The gost tls methods are
+// only taken on listeners with a certificate.
+type Socks5Selector struct {
+    Authenticator_ gost.Authenticator
+    TLSConfig_     *tls.Config
+}
+
+func (self *Socks5Selector) Methods() []uint8 {
+    return []uint8{gosocks5.MethodNoAuth, gosocks5.MethodUserPass, gost.MethodTLS, gost.MethodTLSAuth}
+}
+
+func (self *Socks5Selector) Select(methods ...uint8) uint8 {
+    method := gosocks5.MethodNoAuth
+    for _, v := range methods {
+        if v == gost.MethodTLS && self.TLSConfig_ != nil {
+            method = v
+            break
+        }
+    }
+    // with an authenticator the credentials are mandatory
+    if self.Authenticator_ != nil {
+        switch method {
+        case gosocks5.MethodNoAuth:
+            method = gosocks5.MethodUserPass
+        case gost.MethodTLS:
+            method = gost.MethodTLSAuth
+        }
+    }
+    return method
+}
+
+func (self *Socks5Selector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+    switch method {
+    case gost.MethodTLS:
+        conn = tls.Server(conn, self.TLSConfig_)
+    case gosocks5.MethodUserPass, gost.MethodTLSAuth:
+        if method == gost.MethodTLSAuth {
+            conn = tls.Server(conn, self.TLSConfig_)
+        }
+        req, err := gosocks5.ReadUserPassRequest(conn)
+        if err != nil {
+            return nil, err
+        }
+        if self.Authenticator_ != nil && !self.Authenticator_.Authenticate(req.Username, req.Password) {
+            _ = gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure).Write(conn)
+            return nil, gosocks5.ErrAuthFailure
+        }
+        err = gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Succeeded).Write(conn)
+        if err != nil {
+            return nil, err
+        }
+    case gosocks5.MethodNoAcceptable:
+        return nil, gosocks5.ErrBadMethod
+    }
+    return conn, nil
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "lambdaproxy/tunnel"
+    "lambdaproxy/wire"
+)
+
+const (
+    _TransparentDialTimeout = 30 * time.Second
+)
+
+// IsTransparent tells whether node is a red:// listener taking connections
+// iptables redirected to it, with ?tproxy=true for TPROXY rules instead of
+// REDIRECT.
+func IsTransparent(node *gost.Node) bool {
+    return node.Protocol == "red" || node.Protocol == "redirect"
+}
+
+// TransparentHandler serves a redirected or forwarded connection. There is
+// no proxy protocol to speak, the target is the fixed one of a forward or
+// the original destination read off the socket, and the agent is told in a
+// stream header where to dial.
+type TransparentHandler struct {
+    Listener_ *ProxyListener
+    Session_  *ProxySession
+    TProxy_   bool
+    Target_   string
+}
+
+func (self *TransparentHandler) Init(options ...gost.HandlerOption) {
+}
+
+func (self *TransparentHandler) Handle(conn net.Conn) {
+    defer conn.Close()
+
+    target := self.Target_
+    var err error
+    if target == "" {
+        target, err = OriginalDst(conn, self.TProxy_)
+    }
+    if err == nil && self.Target_ == "" && !self.TProxy_ && target == conn.LocalAddr().String() {
+        err = errors.New("connection was not redirected")
+    }
+    if err != nil {
+        log.Printf("session %d: original destination: %v", self.Session_.Id_, err)
+        self.Session_.SetReason("original destination: " + err.Error())
+        return
+    }
+
+    connector := &SessionConnector{
+        Connector_: &tunnel.DialConnector{Flags_: wire.FlagRaw},
+        Proxyer_:   self.Listener_.Proxyer_,
+        Session_:   self.Session_,
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), _TransparentDialTimeout)
+    cc, err := connector.ConnectContext(ctx, nil, "tcp", target)
+    cancel()
+    if err != nil {
+        return
+    }
+    self.Listener_.Proxyer_.IOCopy(conn, cc)
+}
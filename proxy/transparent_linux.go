@@ -0,0 +1,93 @@
+//go:build linux
+
+package proxy
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "net"
+    "strconv"
+    "syscall"
+    "unsafe"
+)
+
+const (
+    // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of the netfilter headers
+    _SoOriginalDst = 80
+    // IPV6_TRANSPARENT of linux/in6.h, missing from syscall
+    _Ipv6Transparent = 75
+)
+
+// OriginalDst returns where a redirected connection was going. REDIRECT
+// rewrites the destination and keeps the original in conntrack, TPROXY
+// leaves it as the local address of the socket.
+func OriginalDst(conn net.Conn, tproxy bool) (string, error) {
+    if tproxy {
+        return conn.LocalAddr().String(), nil
+    }
+
+    sysConn, ok := conn.(syscall.Conn)
+    if !ok {
+        return "", errors.New("not a tcp connection")
+    }
+    raw, err := sysConn.SyscallConn()
+    if err != nil {
+        return "", err
+    }
+    local, _ := conn.LocalAddr().(*net.TCPAddr)
+
+    var target string
+    var sockErr error
+    err = raw.Control(func(fd uintptr) {
+        if local != nil && local.IP.To4() == nil {
+            // sockaddr_in6 fits the start of ip6_mtuinfo
+            info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, _SoOriginalDst)
+            if err != nil {
+                sockErr = err
+                return
+            }
+            // the port is kept in network order
+            port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+            target = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+            return
+        }
+        // sockaddr_in fits ip_mreq
+        mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, _SoOriginalDst)
+        if err != nil {
+            sockErr = err
+            return
+        }
+        port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+        target = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+    })
+    if err != nil {
+        return "", err
+    }
+    if sockErr != nil {
+        return "", sockErr
+    }
+    return target, nil
+}
+
+// TransparentListener listens with IP_TRANSPARENT, or IPV6_TRANSPARENT on
+// v6 sockets, so TPROXY rules can hand it connections to any address.
+func TransparentListener(addr string) (net.Listener, error) {
+    config := net.ListenConfig{
+        Control: func(network, address string, raw syscall.RawConn) error {
+            var sockErr error
+            err := raw.Control(func(fd uintptr) {
+                if network == "tcp6" {
+                    sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, _Ipv6Transparent, 1)
+                    return
+                }
+                sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+            })
+            if err != nil {
+                return err
+            }
+            return sockErr
+        },
+    }
+    return config.Listen(context.Background(), "tcp", addr)
+}
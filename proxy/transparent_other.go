@@ -0,0 +1,16 @@
+//go:build !linux
+
+package proxy
+
+import (
+    "errors"
+    "net"
+)
+
+func OriginalDst(conn net.Conn, tproxy bool) (string, error) {
+    return "", errors.New("transparent listeners need linux")
+}
+
+func TransparentListener(addr string) (net.Listener, error) {
+    return nil, errors.New("transparent listeners need linux")
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "lambdaproxy/backend"
+)
+
+const (
+    _UsageSavePeriod = 30 * time.Second
+    _UsageMonth      = "2006-01"
+    // hosts kept from one month to the next, a month may grow up to
+    // _UsageHostsSlack times as many before the least used are dropped
+    _UsageMaxHosts   = 1000
+    _UsageHostsSlack = 4
+)
+
+// UsageCounter counts bytes sent by the client (up) and received from the
+// target (down), for the running month and since the usage file was created.
+type UsageCounter struct {
+    MonthUp   int64 `json:"month_up"`
+    MonthDown int64 `json:"month_down"`
+    TotalUp   int64 `json:"total_up"`
+    TotalDown int64 `json:"total_down"`
+}
+
+func (self *UsageCounter) Add(up int64, down int64) {
+    self.MonthUp += up
+    self.MonthDown += down
+    self.TotalUp += up
+    self.TotalDown += down
+}
+
+func (self *UsageCounter) Month() int64 {
+    return self.MonthUp + self.MonthDown
+}
+
+type UsageFile struct {
+    Month string                   `json:"month"`
+    Users map[string]*UsageCounter `json:"users"`
+    Hosts map[string]*UsageCounter `json:"hosts"`
+}
+
+// UsageDB accounts the proxied bytes per user and per target host and keeps
+// one token bucket per user with a bandwidth limit. With a path the totals
+// are saved periodically and loaded again on start. Only the most used
+// hosts are kept, see PruneHosts.
+type UsageDB struct {
+    Path_     string
+    Mutex_    sync.Mutex
+    Month_    string
+    Users_    map[string]*UsageCounter
+    Hosts_    map[string]*UsageCounter
+    Limiters_ map[string]*TokenBucket
+    Dirty_    bool
+}
+
+func NewUsageDB(path string) (*UsageDB, error) {
+    var db = new(UsageDB)
+    db.Path_ = path
+    db.Month_ = time.Now().Format(_UsageMonth)
+    db.Users_ = make(map[string]*UsageCounter)
+    db.Hosts_ = make(map[string]*UsageCounter)
+    db.Limiters_ = make(map[string]*TokenBucket)
+
+    if path == "" {
+        return db, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return db, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("cannot read usage file: %w", err)
+    }
+
+    var file UsageFile
+    err = json.Unmarshal(data, &file)
+    if err != nil {
+        return nil, fmt.Errorf("cannot parse usage file %s: %w", path, err)
+    }
+    if file.Users != nil {
+        db.Users_ = file.Users
+    }
+    // files written before hosts were counted without the port
+    for k, v := range file.Hosts {
+        host, _ := SplitTarget(k)
+        counter := db.Hosts_[host]
+        if counter == nil {
+            counter = new(UsageCounter)
+            db.Hosts_[host] = counter
+        }
+        counter.MonthUp += v.MonthUp
+        counter.MonthDown += v.MonthDown
+        counter.TotalUp += v.TotalUp
+        counter.TotalDown += v.TotalDown
+    }
+    db.Month_ = file.Month
+    db.Rollover(time.Now())
+
+    return db, nil
+}
+
+// Rollover starts a new month for every counter, only the hosts most used
+// in the month before are kept. The caller holds Mutex_ unless the db is not
+// shared yet.
+func (self *UsageDB) Rollover(now time.Time) {
+    month := now.Format(_UsageMonth)
+    if month == self.Month_ {
+        return
+    }
+    self.PruneHosts(_UsageMaxHosts)
+    for _, counter := range self.Users_ {
+        counter.MonthUp, counter.MonthDown = 0, 0
+    }
+    for _, counter := range self.Hosts_ {
+        counter.MonthUp, counter.MonthDown = 0, 0
+    }
+    self.Month_ = month
+    self.Dirty_ = true
+}
+
+// Add accounts bytes of one connection to a host:port target and returns
+// the user's bytes this month. Hosts are counted without the port,
+// connections without a user are only accounted per host.
+func (self *UsageDB) Add(user string, host string, up int64, down int64) int64 {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    self.Rollover(time.Now())
+    self.Dirty_ = true
+
+    host, _ = SplitTarget(host)
+    if host != "" {
+        counter := self.Hosts_[host]
+        if counter == nil {
+            if len(self.Hosts_) >= _UsageMaxHosts*_UsageHostsSlack {
+                self.PruneHosts(_UsageMaxHosts)
+            }
+            counter = new(UsageCounter)
+            self.Hosts_[host] = counter
+        }
+        counter.Add(up, down)
+    }
+
+    if user == "" {
+        return 0
+    }
+    counter := self.Users_[user]
+    if counter == nil {
+        counter = new(UsageCounter)
+        self.Users_[user] = counter
+    }
+    counter.Add(up, down)
+    return counter.Month()
+}
+
+func (self *UsageDB) User(user string) UsageCounter {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    self.Rollover(time.Now())
+    if counter := self.Users_[user]; counter != nil {
+        return *counter
+    }
+    return UsageCounter{}
+}
+
+func (self *UsageDB) OverQuota(user *User) bool {
+    if user.MonthlyQuota_ <= 0 {
+        return false
+    }
+    usage := self.User(user.Name_)
+    return usage.Month() >= user.MonthlyQuota_
+}
+
+// Limiter returns the user's shared token bucket, nil without a bandwidth
+// limit. A changed limit in the users file replaces the bucket.
+func (self *UsageDB) Limiter(user *User) *TokenBucket {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if user.Bandwidth_ <= 0 {
+        delete(self.Limiters_, user.Name_)
+        return nil
+    }
+    limiter := self.Limiters_[user.Name_]
+    if limiter == nil || limiter.Rate_ != user.Bandwidth_ {
+        limiter = NewTokenBucket(user.Bandwidth_)
+        self.Limiters_[user.Name_] = limiter
+    }
+    return limiter
+}
+
+// Snapshot copies the counters for the api and for saving.
+func (self *UsageDB) Snapshot() *UsageFile {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    self.Rollover(time.Now())
+    file := &UsageFile{
+        Month: self.Month_,
+        Users: make(map[string]*UsageCounter, len(self.Users_)),
+        Hosts: make(map[string]*UsageCounter, len(self.Hosts_)),
+    }
+    for k, v := range self.Users_ {
+        counter := *v
+        file.Users[k] = &counter
+    }
+    for k, v := range self.Hosts_ {
+        counter := *v
+        file.Hosts[k] = &counter
+    }
+    return file
+}
+
+// TopHosts returns up to limit hosts ordered by bytes this month.
+func (self *UsageDB) TopHosts(limit int) []string {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+    return self.SortHosts(limit)
+}
+
+// PruneHosts keeps the limit hosts with the most bytes this month, hosts
+// without any are dropped. The caller holds Mutex_.
+func (self *UsageDB) PruneHosts(limit int) {
+    keep := self.SortHosts(limit)
+    hosts := make(map[string]*UsageCounter, len(keep))
+    for _, host := range keep {
+        if counter := self.Hosts_[host]; counter.Month() > 0 {
+            hosts[host] = counter
+        }
+    }
+    self.Hosts_ = hosts
+}
+
+// SortHosts orders the hosts by bytes this month. The caller holds Mutex_.
+func (self *UsageDB) SortHosts(limit int) []string {
+    hosts := make([]string, 0, len(self.Hosts_))
+    for k := range self.Hosts_ {
+        hosts = append(hosts, k)
+    }
+    sort.Slice(hosts, func(i, j int) bool {
+        return self.Hosts_[hosts[i]].Month() > self.Hosts_[hosts[j]].Month()
+    })
+    if limit > 0 && len(hosts) > limit {
+        hosts = hosts[:limit]
+    }
+    return hosts
+}
+
+// Save writes the usage file through a temporary file, so a crash never
+// leaves it half written.
+func (self *UsageDB) Save() error {
+    if self.Path_ == "" {
+        return nil
+    }
+
+    self.Mutex_.Lock()
+    dirty := self.Dirty_
+    self.Dirty_ = false
+    self.Mutex_.Unlock()
+    if !dirty {
+        return nil
+    }
+
+    err := self.WriteFile(self.Snapshot())
+    if err != nil {
+        self.Mutex_.Lock()
+        self.Dirty_ = true
+        self.Mutex_.Unlock()
+    }
+    return err
+}
+
+func (self *UsageDB) WriteFile(file *UsageFile) error {
+    data, err := json.MarshalIndent(file, "", "    ")
+    if err != nil {
+        return err
+    }
+
+    tmp := self.Path_ + ".tmp"
+    err = os.WriteFile(tmp, data, 0600)
+    if err != nil {
+        return fmt.Errorf("cannot write usage file: %w", err)
+    }
+    err = os.Rename(tmp, self.Path_)
+    if err != nil {
+        return fmt.Errorf("cannot write usage file: %w", err)
+    }
+    return nil
+}
+
+func (self *UsageDB) RunSave(ctx context.Context) {
+    for {
+        if backend.SleepContext(ctx, _UsageSavePeriod) != nil {
+            return
+        }
+        err := self.Save()
+        if err != nil {
+            log.Printf("unable to save usage: %v", err)
+        }
+    }
+}
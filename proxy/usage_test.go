@@ -0,0 +1,170 @@
+package proxy
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestUsageDBAdd(t *testing.T) {
+    db, err := NewUsageDB("")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        User   string
+        Target string
+        Up     int64
+        Down   int64
+        Month  int64
+    }{
+        {"alice", "example.com:443", 10, 100, 110},
+        {"alice", "Example.COM.:80", 1, 2, 113},
+        {"bob", "[2001:db8::1]:443", 5, 5, 10},
+        {"", "example.com:443", 7, 0, 0},
+    }
+    for _, test := range tests {
+        if month := db.Add(test.User, test.Target, test.Up, test.Down); month != test.Month {
+            t.Errorf("%s %s: month %d, want %d", test.User, test.Target, month, test.Month)
+        }
+    }
+
+    if usage := db.User("alice"); usage != (UsageCounter{11, 102, 11, 102}) {
+        t.Errorf("alice %+v", usage)
+    }
+    snapshot := db.Snapshot()
+    if len(snapshot.Hosts) != 2 {
+        t.Errorf("hosts %v", snapshot.Hosts)
+    }
+    if counter := snapshot.Hosts["example.com"]; counter == nil || *counter != (UsageCounter{18, 102, 18, 102}) {
+        t.Errorf("example.com %+v", counter)
+    }
+    if counter := snapshot.Hosts["2001:db8::1"]; counter == nil || counter.Month() != 10 {
+        t.Errorf("2001:db8::1 %+v", counter)
+    }
+}
+
+func TestUsageDBRollover(t *testing.T) {
+    db, err := NewUsageDB("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Month_ = "2001-01"
+    db.Users_["alice"] = &UsageCounter{10, 20, 100, 200}
+    for i := 0; i < _UsageMaxHosts+10; i++ {
+        db.Hosts_[fmt.Sprintf("host%d.example.com", i)] = &UsageCounter{int64(i), 0, int64(i), 0}
+    }
+    db.Hosts_["old.example.com"] = &UsageCounter{0, 0, 1 << 40, 0}
+
+    db.Rollover(time.Date(2001, 1, 31, 0, 0, 0, 0, time.UTC))
+    if db.Users_["alice"].Month() != 30 || len(db.Hosts_) != _UsageMaxHosts+11 {
+        t.Fatal("rolled over within the month")
+    }
+
+    db.Rollover(time.Date(2001, 2, 1, 0, 0, 0, 0, time.UTC))
+    if db.Month_ != "2001-02" || !db.Dirty_ {
+        t.Errorf("month %s dirty %v", db.Month_, db.Dirty_)
+    }
+    if usage := *db.Users_["alice"]; usage != (UsageCounter{0, 0, 100, 200}) {
+        t.Errorf("alice %+v", usage)
+    }
+    // the most used hosts of january are kept, idle ones dropped
+    if len(db.Hosts_) != _UsageMaxHosts {
+        t.Errorf("%d hosts kept", len(db.Hosts_))
+    }
+    for _, host := range []string{"host0.example.com", "host9.example.com", "old.example.com"} {
+        if db.Hosts_[host] != nil {
+            t.Errorf("%s kept", host)
+        }
+    }
+    if counter := db.Hosts_["host1009.example.com"]; counter == nil || *counter != (UsageCounter{0, 0, 1009, 0}) {
+        t.Errorf("host1009.example.com %+v", counter)
+    }
+}
+
+func TestUsageDBPruneHosts(t *testing.T) {
+    db, err := NewUsageDB("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < _UsageMaxHosts*_UsageHostsSlack; i++ {
+        db.Add("", fmt.Sprintf("host%d.example.com:443", i), int64(i+1), 0)
+    }
+    if len(db.Hosts_) != _UsageMaxHosts*_UsageHostsSlack {
+        t.Fatalf("%d hosts", len(db.Hosts_))
+    }
+    db.Add("", "new.example.com:443", 1, 0)
+    if len(db.Hosts_) != _UsageMaxHosts+1 || db.Hosts_["new.example.com"] == nil || db.Hosts_["host0.example.com"] != nil {
+        t.Errorf("%d hosts after pruning", len(db.Hosts_))
+    }
+    if hosts := db.TopHosts(2); len(hosts) != 2 || hosts[0] != "host3999.example.com" || hosts[1] != "host3998.example.com" {
+        t.Errorf("top hosts %v", hosts)
+    }
+}
+
+func TestUsageDBQuota(t *testing.T) {
+    db, err := NewUsageDB("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        User  *User
+        Bytes int64
+        Over  bool
+    }{
+        {&User{Name_: "alice", MonthlyQuota_: 100}, 99, false},
+        {&User{Name_: "bob", MonthlyQuota_: 100}, 100, true},
+        {&User{Name_: "carol", MonthlyQuota_: 100}, 1000, true},
+        {&User{Name_: "dave"}, 1000, false},
+    }
+    for _, test := range tests {
+        db.Add(test.User.Name_, "example.com:443", test.Bytes, 0)
+        if over := db.OverQuota(test.User); over != test.Over {
+            t.Errorf("%s after %d bytes: over quota %v, want %v", test.User.Name_, test.Bytes, over, test.Over)
+        }
+    }
+
+    // a new month gives the quota back
+    db.Month_ = "2001-01"
+    if db.OverQuota(tests[1].User) {
+        t.Error("over quota in a new month")
+    }
+}
+
+func TestUsageDBSave(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "usage.json")
+    month := time.Now().Format(_UsageMonth)
+    err := os.WriteFile(path, []byte(`{"month": "`+month+`",
+        "users": {"alice": {"month_up": 1, "month_down": 2, "total_up": 3, "total_down": 4}},
+        "hosts": {"example.com:443": {"month_up": 1, "total_up": 1}, "example.com:80": {"month_up": 2, "total_up": 2}}}`), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    db, err := NewUsageDB(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // keys written with the port are merged per host
+    if counter := db.Hosts_["example.com"]; len(db.Hosts_) != 1 || counter == nil || counter.Month() != 3 {
+        t.Errorf("hosts %v", db.Hosts_)
+    }
+
+    db.Add("alice", "example.org:443", 10, 0)
+    if err = db.Save(); err != nil {
+        t.Fatal(err)
+    }
+    db, err = NewUsageDB(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if usage := db.User("alice"); usage != (UsageCounter{11, 2, 13, 4}) {
+        t.Errorf("alice %+v", usage)
+    }
+    if len(db.Hosts_) != 2 {
+        t.Errorf("hosts %v", db.Hosts_)
+    }
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+const (
+    _UsersReloadPeriod = 5 * time.Second
+
+    // bounds of the argon2id parameters, every login pays for them
+    _Argon2MaxMemory     = 256 * 1024
+    _Argon2MaxIterations = 16
+)
+
+// UserConfig is one entry of the -users file. Zero limits mean unlimited.
+type UserConfig struct {
+    Name         string   `json:"name"`
+    PasswordHash string   `json:"password_hash"`
+    Regions      []string `json:"regions"`
+    MaxConns     int64    `json:"max_conns"`
+    Bandwidth    int64    `json:"bandwidth"`
+    MonthlyQuota int64    `json:"monthly_quota"`
+    Expires      string   `json:"expires"`
+}
+
+type User struct {
+    Name_         string
+    PasswordHash_ string
+    Argon2id_     *Argon2idHash
+    Regions_      []string
+    MaxConns_     int64
+    Bandwidth_    int64
+    MonthlyQuota_ int64
+    Expires_      time.Time
+}
+
+func NewUser(config *UserConfig) (*User, error) {
+    if config.Name == "" {
+        return nil, errors.New("user without name")
+    }
+    var argon2id *Argon2idHash
+    switch {
+    case strings.HasPrefix(config.PasswordHash, "$argon2id$"):
+        var err error
+        argon2id, err = ParseArgon2id(config.PasswordHash)
+        if err != nil {
+            return nil, fmt.Errorf("user %s: %w", config.Name, err)
+        }
+    case strings.HasPrefix(config.PasswordHash, "$2"):
+        if _, err := bcrypt.Cost([]byte(config.PasswordHash)); err != nil {
+            return nil, fmt.Errorf("user %s: bad bcrypt hash: %w", config.Name, err)
+        }
+    default:
+        return nil, fmt.Errorf("user %s: password_hash must be bcrypt or argon2id", config.Name)
+    }
+
+    user := &User{
+        Name_:         config.Name,
+        PasswordHash_: config.PasswordHash,
+        Argon2id_:     argon2id,
+        Regions_:      config.Regions,
+        MaxConns_:     config.MaxConns,
+        Bandwidth_:    config.Bandwidth,
+        MonthlyQuota_: config.MonthlyQuota,
+    }
+    if config.Expires != "" {
+        expires, err := time.Parse(time.RFC3339, config.Expires)
+        if err != nil {
+            expires, err = time.Parse("2006-01-02", config.Expires)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("user %s: bad expires %q", config.Name, config.Expires)
+        }
+        user.Expires_ = expires
+    }
+    return user, nil
+}
+
+func (self *User) Expired(now time.Time) bool {
+    return !self.Expires_.IsZero() && now.After(self.Expires_)
+}
+
+// VerifyPassword checks password against the hash parsed on load.
+func (self *User) VerifyPassword(password string) bool {
+    if self.Argon2id_ != nil {
+        return self.Argon2id_.Verify(password)
+    }
+    return bcrypt.CompareHashAndPassword([]byte(self.PasswordHash_), []byte(password)) == nil
+}
+
+// UserDB is a gost.Authenticator backed by a json users file. It also
+// implements gost.Reloader so gost.PeriodReload picks up changes, a file
+// that fails to parse keeps the previous users.
+type UserDB struct {
+    Path_     string
+    Mutex_    sync.RWMutex
+    Users_    map[string]*User
+    Verified_ map[string][32]byte
+    Active_   map[string]int64
+}
+
+func NewUserDB(path string) (*UserDB, error) {
+    var db = new(UserDB)
+    db.Path_ = path
+    db.Users_ = make(map[string]*User)
+    db.Verified_ = make(map[string][32]byte)
+    db.Active_ = make(map[string]int64)
+
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("cannot open users file: %w", err)
+    }
+    defer f.Close()
+
+    err = db.Reload(f)
+    if err != nil {
+        return nil, err
+    }
+    go gost.PeriodReload(db, path)
+
+    return db, nil
+}
+
+func (self *UserDB) Reload(r io.Reader) error {
+    var configs []*UserConfig
+    err := json.NewDecoder(r).Decode(&configs)
+    if err != nil {
+        return fmt.Errorf("cannot parse users file %s: %w", self.Path_, err)
+    }
+
+    users := make(map[string]*User, len(configs))
+    for _, config := range configs {
+        user, err := NewUser(config)
+        if err != nil {
+            return err
+        }
+        users[user.Name_] = user
+    }
+
+    self.Mutex_.Lock()
+    self.Users_ = users
+    self.Verified_ = make(map[string][32]byte)
+    self.Mutex_.Unlock()
+
+    log.Printf("loaded %d users from %s", len(users), self.Path_)
+    return nil
+}
+
+func (self *UserDB) Period() time.Duration {
+    return _UsersReloadPeriod
+}
+
+func (self *UserDB) Get(name string) *User {
+    self.Mutex_.RLock()
+    defer self.Mutex_.RUnlock()
+    return self.Users_[name]
+}
+
+func (self *UserDB) Names() []string {
+    self.Mutex_.RLock()
+    defer self.Mutex_.RUnlock()
+
+    names := make([]string, 0, len(self.Users_))
+    for name := range self.Users_ {
+        names = append(names, name)
+    }
+    return names
+}
+
+func (self *UserDB) ActiveConns(name string) int64 {
+    self.Mutex_.RLock()
+    defer self.Mutex_.RUnlock()
+    return self.Active_[name]
+}
+
+// Authenticate checks the password against the stored hash. A successful
+// check is remembered as a sha256 so keep-alive clients don't pay for a
+// bcrypt/argon2 round on every request.
+func (self *UserDB) Authenticate(name, password string) bool {
+    user := self.Get(name)
+    if user == nil || user.Expired(time.Now()) {
+        return false
+    }
+
+    sum := sha256.Sum256([]byte(password))
+    self.Mutex_.RLock()
+    verified, ok := self.Verified_[name]
+    self.Mutex_.RUnlock()
+    if ok && subtle.ConstantTimeCompare(verified[:], sum[:]) == 1 {
+        return true
+    }
+
+    if !user.VerifyPassword(password) {
+        return false
+    }
+
+    self.Mutex_.Lock()
+    if self.Users_[name] == user {
+        self.Verified_[name] = sum
+    }
+    self.Mutex_.Unlock()
+    return true
+}
+
+// Acquire takes one of the user's concurrent connection slots.
+func (self *UserDB) Acquire(user *User) bool {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    if user.MaxConns_ > 0 && self.Active_[user.Name_] >= user.MaxConns_ {
+        return false
+    }
+    self.Active_[user.Name_]++
+    return true
+}
+
+func (self *UserDB) Release(user *User) {
+    self.Mutex_.Lock()
+    defer self.Mutex_.Unlock()
+
+    self.Active_[user.Name_]--
+    if self.Active_[user.Name_] <= 0 {
+        delete(self.Active_, user.Name_)
+    }
+}
+
+// Argon2idHash is a parsed PHC formatted hash:
+// $argon2id$v=19$m=65536,t=3,p=2$<base64 salt>$<base64 key>
+type Argon2idHash struct {
+    Memory_     uint32
+    Iterations_ uint32
+    Threads_    uint8
+    Salt_       []byte
+    Key_        []byte
+}
+
+// ParseArgon2id checks the parameters once, so a users file can't make a
+// login panic or allocate without bound.
+func ParseArgon2id(hash string) (*Argon2idHash, error) {
+    parts := strings.Split(hash, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return nil, errors.New("bad argon2id hash")
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return nil, fmt.Errorf("argon2id version must be %d", argon2.Version)
+    }
+    var argon = new(Argon2idHash)
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &argon.Memory_, &argon.Iterations_, &argon.Threads_); err != nil {
+        return nil, fmt.Errorf("bad argon2id parameters %q", parts[3])
+    }
+    if argon.Iterations_ < 1 || argon.Iterations_ > _Argon2MaxIterations {
+        return nil, fmt.Errorf("argon2id t must be 1 to %d", _Argon2MaxIterations)
+    }
+    if argon.Threads_ < 1 {
+        return nil, errors.New("argon2id p must be at least 1")
+    }
+    if argon.Memory_ < 8*uint32(argon.Threads_) || argon.Memory_ > _Argon2MaxMemory {
+        return nil, fmt.Errorf("argon2id m must be 8*p to %d", _Argon2MaxMemory)
+    }
+
+    var err error
+    argon.Salt_, err = base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil || len(argon.Salt_) == 0 {
+        return nil, errors.New("bad argon2id salt")
+    }
+    argon.Key_, err = base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(argon.Key_) == 0 {
+        return nil, errors.New("bad argon2id key")
+    }
+    return argon, nil
+}
+
+func (self *Argon2idHash) Verify(password string) bool {
+    derived := argon2.IDKey([]byte(password), self.Salt_, self.Iterations_, self.Memory_, self.Threads_, uint32(len(self.Key_)))
+    return subtle.ConstantTimeCompare(derived, self.Key_) == 1
+}
+
+func HashPassword(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return "", err
+    }
+    return string(hash), nil
+}
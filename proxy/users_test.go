@@ -0,0 +1,194 @@
+package proxy
+
+import (
+    "encoding/base64"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+func HashArgon2id(password string, salt string) string {
+    key := argon2.IDKey([]byte(password), []byte(salt), 1, 1024, 1, 32)
+    return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+        base64.RawStdEncoding.EncodeToString([]byte(salt)), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPassword(t *testing.T) {
+    bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    argonHash := HashArgon2id("secret", "saltsaltsalt")
+
+    tests := []struct {
+        Hash     string
+        Password string
+        Ok       bool
+    }{
+        {string(bcryptHash), "secret", true},
+        {string(bcryptHash), "Secret", false},
+        {string(bcryptHash), "", false},
+        {argonHash, "secret", true},
+        {argonHash, "secret2", false},
+        {strings.Replace(argonHash, "m=1024", "m=2048", 1), "secret", false},
+    }
+    for i, test := range tests {
+        user, err := NewUser(&UserConfig{Name: "alice", PasswordHash: test.Hash})
+        if err != nil {
+            t.Fatalf("test %d: %v", i, err)
+        }
+        if ok := user.VerifyPassword(test.Password); ok != test.Ok {
+            t.Errorf("test %d: %q against %s: %v, want %v", i, test.Password, test.Hash, ok, test.Ok)
+        }
+    }
+}
+
+func TestParseArgon2id(t *testing.T) {
+    argonHash := HashArgon2id("secret", "saltsaltsalt")
+    argon, err := ParseArgon2id(argonHash)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if argon.Memory_ != 1024 || argon.Iterations_ != 1 || argon.Threads_ != 1 || string(argon.Salt_) != "saltsaltsalt" || len(argon.Key_) != 32 {
+        t.Errorf("parsed %+v", *argon)
+    }
+
+    // parameters that would panic in argon2.IDKey or allocate without bound
+    bad := []string{
+        strings.Replace(argonHash, "v=19", "v=16", 1),
+        strings.Replace(argonHash, "t=1", "t=0", 1),
+        strings.Replace(argonHash, "t=1", "t=1000", 1),
+        strings.Replace(argonHash, "p=1", "p=0", 1),
+        strings.Replace(argonHash, "p=1", "p=256", 1),
+        strings.Replace(argonHash, "m=1024", "m=4", 1),
+        strings.Replace(argonHash, "m=1024", "m=4194304", 1),
+        strings.Replace(argonHash, "m=1024", "m=-1", 1),
+        strings.Replace(argonHash, "m=1024,t=1,p=1", "m=1024", 1),
+        strings.Replace(argonHash, "$argon2id$", "$argon2i$", 1),
+        "$argon2id$v=19$m=1024,t=1,p=1$$a2V5",
+        "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+        "$argon2id$v=19$m=1024,t=1,p=1$!!$!!",
+        "$argon2id$v=19$m=1024,t=1,p=1",
+    }
+    for _, hash := range bad {
+        if _, err := ParseArgon2id(hash); err == nil {
+            t.Errorf("%s accepted", hash)
+        }
+        if _, err := NewUser(&UserConfig{Name: "alice", PasswordHash: hash}); err == nil {
+            t.Errorf("user with %s accepted", hash)
+        }
+    }
+}
+
+func TestNewUser(t *testing.T) {
+    argonHash := HashArgon2id("secret", "saltsaltsalt")
+
+    user, err := NewUser(&UserConfig{Name: "alice", PasswordHash: argonHash, Expires: "2030-01-02"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !user.Expires_.Equal(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("expires %v", user.Expires_)
+    }
+    if user.Expired(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) || !user.Expired(time.Date(2030, 1, 3, 0, 0, 0, 0, time.UTC)) {
+        t.Error("wrong expiry")
+    }
+
+    user, err = NewUser(&UserConfig{Name: "bob", PasswordHash: argonHash, Expires: "2030-01-02T10:00:00+02:00"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !user.Expires_.Equal(time.Date(2030, 1, 2, 8, 0, 0, 0, time.UTC)) {
+        t.Errorf("expires %v", user.Expires_)
+    }
+
+    user, err = NewUser(&UserConfig{Name: "carol", PasswordHash: argonHash})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if user.Expired(time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Error("user without expires expired")
+    }
+
+    bad := []*UserConfig{
+        {PasswordHash: argonHash},
+        {Name: "alice", PasswordHash: "secret"},
+        {Name: "alice", PasswordHash: "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5"},
+        {Name: "alice", PasswordHash: "$2a$10$short"},
+        {Name: "alice", PasswordHash: argonHash, Expires: "next year"},
+        {Name: "alice", PasswordHash: argonHash, Expires: "2030-13-01"},
+    }
+    for _, config := range bad {
+        if _, err := NewUser(config); err == nil {
+            t.Errorf("%+v accepted", *config)
+        }
+    }
+}
+
+func TestUserDBReload(t *testing.T) {
+    argonHash := HashArgon2id("secret", "saltsaltsalt")
+    db := &UserDB{Users_: map[string]*User{}, Verified_: map[string][32]byte{}, Active_: map[string]int64{}}
+
+    err := db.Reload(strings.NewReader(fmt.Sprintf(`[
+        {"name": "alice", "password_hash": %q, "regions": ["eu-west-1", "eu-central-1"], "max_conns": 1},
+        {"name": "bob", "password_hash": %q, "expires": "2000-01-01"}
+    ]`, argonHash, argonHash)))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    alice := db.Get("alice")
+    if alice == nil || strings.Join(alice.Regions_, ",") != "eu-west-1,eu-central-1" {
+        t.Fatalf("alice %+v", alice)
+    }
+    if bob := db.Get("bob"); bob == nil || len(bob.Regions_) != 0 {
+        t.Fatalf("bob %+v", bob)
+    }
+
+    tests := []struct {
+        Name     string
+        Password string
+        Ok       bool
+    }{
+        {"alice", "secret", true},
+        // the second time is answered from the verified cache
+        {"alice", "secret", true},
+        {"alice", "wrong", false},
+        {"bob", "secret", false},
+        {"carol", "secret", false},
+    }
+    for _, test := range tests {
+        if ok := db.Authenticate(test.Name, test.Password); ok != test.Ok {
+            t.Errorf("%s/%s: %v, want %v", test.Name, test.Password, ok, test.Ok)
+        }
+    }
+
+    if !db.Acquire(alice) || db.Acquire(alice) {
+        t.Error("max_conns not applied")
+    }
+    db.Release(alice)
+    if db.ActiveConns("alice") != 0 || !db.Acquire(alice) {
+        t.Error("slot not released")
+    }
+
+    // a file that fails to parse keeps the users loaded before
+    if err = db.Reload(strings.NewReader(`[{"name": "alice", "password_hash": "plain"}]`)); err == nil {
+        t.Error("bad users file reloaded")
+    }
+    if db.Get("bob") == nil {
+        t.Error("users lost after a failed reload")
+    }
+
+    // a reload drops the verified cache, so a changed password is checked again
+    if err = db.Reload(strings.NewReader(fmt.Sprintf(`[{"name": "alice", "password_hash": %q}]`,
+        HashArgon2id("other", "saltsaltsalt")))); err != nil {
+        t.Fatal(err)
+    }
+    if db.Authenticate("alice", "secret") || !db.Authenticate("alice", "other") {
+        t.Error("old password accepted after reload")
+    }
+}
@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+
+    "lambdaproxy/wire"
+)
+
+const (
+    // loopback, private, shared, link-local (instance metadata) and
+    // unspecified ranges, for v4 and v6
+    DefaultEgressDeny = "0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12,192.168.0.0/16,::1/128,::/128,fc00::/7,fe80::/10"
+)
+
+func SplitList(s string) []string {
+    var values []string
+    for _, v := range strings.Split(s, ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            values = append(values, v)
+        }
+    }
+    return values
+}
+
+// ParseEgressPolicy validates the comma separated flag values here, an agent
+// would only fail on them after being invoked.
+func ParseEgressPolicy(deny string, allowDomains string, allowPorts string) (*wire.EgressPolicy, error) {
+    policy := &wire.EgressPolicy{
+        DenyCidrs:    SplitList(deny),
+        AllowDomains: SplitList(allowDomains),
+        AllowPorts:   SplitList(allowPorts),
+    }
+
+    for _, cidr := range policy.DenyCidrs {
+        if _, _, err := net.ParseCIDR(cidr); err != nil {
+            return nil, fmt.Errorf("bad deny cidr %q", cidr)
+        }
+    }
+    for _, ports := range policy.AllowPorts {
+        min, max, isRange := strings.Cut(ports, "-")
+        if !isRange {
+            max = min
+        }
+        portMin, err1 := strconv.Atoi(min)
+        portMax, err2 := strconv.Atoi(max)
+        if err1 != nil || err2 != nil || portMin > portMax {
+            return nil, fmt.Errorf("bad allow port %q", ports)
+        }
+    }
+    return policy, nil
+}
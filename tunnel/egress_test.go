@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestParseEgressPolicy(t *testing.T) {
+    tests := []struct {
+        Name    string
+        Deny    string
+        Domains string
+        Ports   string
+        Ok      bool
+    }{
+        {"default", DefaultEgressDeny, "", "", true},
+        {"lists", " 10.0.0.0/8 ,, fd00::/8", "example.com,.example.org", "80, 443,8000-8999", true},
+        {"empty", "", "", "", true},
+        {"bad cidr", "10.0.0.0", "", "", false},
+        {"bad port", "", "", "http", false},
+        {"reversed range", "", "", "9000-8000", false},
+        {"open range", "", "", "8000-", false},
+    }
+    for _, test := range tests {
+        policy, err := ParseEgressPolicy(test.Deny, test.Domains, test.Ports)
+        if test.Ok != (err == nil) {
+            t.Errorf("%s: %v", test.Name, err)
+        }
+        if err != nil {
+            continue
+        }
+        if got, want := strings.Join(policy.DenyCidrs, ","), strings.Join(SplitList(test.Deny), ","); got != want {
+            t.Errorf("%s: deny %q, want %q", test.Name, got, want)
+        }
+    }
+
+    policy, _ := ParseEgressPolicy("", " example.com ,", "80,443")
+    if len(policy.DenyCidrs) != 0 || strings.Join(policy.AllowDomains, ",") != "example.com" || strings.Join(policy.AllowPorts, ",") != "80,443" {
+        t.Errorf("unexpected policy %+v", policy)
+    }
+}
@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+    "fmt"
+    "strings"
+
+    "lambdaproxy/wire"
+)
+
+const (
+    // headers telling the target about the client or the proxies between
+    DefaultStripHeaders = "Via,Forwarded,X-Forwarded-For,X-Forwarded-Host,X-Forwarded-Proto,X-Real-Ip,Client-Ip,True-Client-Ip,X-Client-Ip,X-Proxy-Id"
+)
+
+// ParseHeaderPolicy validates the header flags, nil when there is nothing
+// to change besides the hop-by-hop headers every agent removes.
+func ParseHeaderPolicy(strip string, userAgent string) (*wire.HeaderPolicy, error) {
+    policy := &wire.HeaderPolicy{
+        Strip:     SplitList(strip),
+        UserAgent: userAgent,
+    }
+    if len(policy.Strip) == 0 && policy.UserAgent == "" {
+        return nil, nil
+    }
+
+    for _, header := range policy.Strip {
+        if strings.ContainsAny(header, " \t:") {
+            return nil, fmt.Errorf("bad header name %q", header)
+        }
+    }
+    if strings.ContainsAny(policy.UserAgent, "\r\n") {
+        return nil, fmt.Errorf("bad user agent %q", policy.UserAgent)
+    }
+    return policy, nil
+}
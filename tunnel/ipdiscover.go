@@ -0,0 +1,325 @@
+package tunnel
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "lambdaproxy/wire"
+)
+
+const (
+    // tried in order, so a network blocking one of them still works
+    DefaultIPDiscovery = "https://checkip.amazonaws.com,https://api.ipify.org,https://icanhazip.com"
+
+    _IPDiscoverTimeout = 10 * time.Second
+
+    _StunBindingRequest  = 0x0001
+    _StunBindingResponse = 0x0101
+    _StunMagicCookie     = 0x2112a442
+    _StunMappedAddress   = 0x0001
+    _StunXorMappedAddr   = 0x0020
+)
+
+// IPNetwork is where an ip is discovered from: Dial_ connects from there,
+// OpenStream_ reaches the agent on a tunnel and is nil on the server.
+type IPNetwork struct {
+    Dial_       func(ctx context.Context, network, address string) (net.Conn, error)
+    OpenStream_ func() (net.Conn, error)
+}
+
+func LocalIPNetwork() *IPNetwork {
+    dialer := &net.Dialer{Timeout: _IPDiscoverTimeout}
+    return &IPNetwork{Dial_: dialer.DialContext}
+}
+
+// IPDiscoverer finds the public ip connections from network come from.
+type IPDiscoverer interface {
+    DiscoverIP(ctx context.Context, network *IPNetwork) (string, error)
+}
+
+// ParseIPDiscoverer reads a comma separated list tried in order:
+// http(s) echo urls, stun://host:port (udp), stun+tcp://host:port,
+// static:<ip>, agent (the agent asks the echo urls itself) or none.
+func ParseIPDiscoverer(spec string) (IPDiscoverer, error) {
+    var discoverers FallbackIPDiscoverer
+    for _, v := range SplitList(spec) {
+        var discoverer IPDiscoverer
+        switch {
+        case v == "none":
+            discoverer = &StaticIPDiscoverer{}
+        case v == "agent":
+            discoverer = &AgentIPDiscoverer{}
+        case strings.HasPrefix(v, "static:"):
+            ip := strings.TrimPrefix(v, "static:")
+            if net.ParseIP(ip) == nil {
+                return nil, fmt.Errorf("bad static ip %q", ip)
+            }
+            discoverer = &StaticIPDiscoverer{IP_: ip}
+        case strings.HasPrefix(v, "http://"), strings.HasPrefix(v, "https://"):
+            if _, err := url.Parse(v); err != nil {
+                return nil, fmt.Errorf("bad ip url %q", v)
+            }
+            discoverer = &HttpIPDiscoverer{Url_: v}
+        case strings.HasPrefix(v, "stun://"), strings.HasPrefix(v, "stun+tcp://"):
+            scheme, addr, _ := strings.Cut(v, "://")
+            if _, _, err := net.SplitHostPort(addr); err != nil {
+                return nil, fmt.Errorf("bad stun server %q", v)
+            }
+            network := "udp"
+            if scheme == "stun+tcp" {
+                network = "tcp"
+            }
+            discoverer = &StunIPDiscoverer{Addr_: addr, Network_: network}
+        default:
+            return nil, fmt.Errorf("unknown ip discovery %q", v)
+        }
+        discoverers = append(discoverers, discoverer)
+    }
+
+    if len(discoverers) == 0 {
+        return nil, errors.New("no ip discovery configured")
+    }
+    if len(discoverers) == 1 {
+        return discoverers[0], nil
+    }
+    return discoverers, nil
+}
+
+// EchoUrls lists the http discoverers of d, the urls an agent asks.
+func EchoUrls(d IPDiscoverer) []string {
+    switch v := d.(type) {
+    case *HttpIPDiscoverer:
+        return []string{v.Url_}
+    case FallbackIPDiscoverer:
+        var urls []string
+        for _, discoverer := range v {
+            urls = append(urls, EchoUrls(discoverer)...)
+        }
+        return urls
+    }
+    return nil
+}
+
+// UsesAgent tells whether d asks the agent, which needs the ip capability.
+func UsesAgent(d IPDiscoverer) bool {
+    switch v := d.(type) {
+    case *AgentIPDiscoverer:
+        return true
+    case FallbackIPDiscoverer:
+        for _, discoverer := range v {
+            if UsesAgent(discoverer) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// FallbackIPDiscoverer tries its discoverers in turn.
+type FallbackIPDiscoverer []IPDiscoverer
+
+func (self FallbackIPDiscoverer) DiscoverIP(ctx context.Context, network *IPNetwork) (string, error) {
+    var errs []error
+    for _, discoverer := range self {
+        ip, err := discoverer.DiscoverIP(ctx, network)
+        if err == nil {
+            return ip, nil
+        }
+        errs = append(errs, err)
+        if ctx.Err() != nil {
+            break
+        }
+    }
+    return "", errors.Join(errs...)
+}
+
+// StaticIPDiscoverer always answers IP_, "" skips the discovery.
+type StaticIPDiscoverer struct {
+    IP_ string
+}
+
+func (self *StaticIPDiscoverer) DiscoverIP(ctx context.Context, network *IPNetwork) (string, error) {
+    return self.IP_, nil
+}
+
+// HttpIPDiscoverer asks an echo service answering the caller ip as text.
+type HttpIPDiscoverer struct {
+    Url_ string
+}
+
+func (self *HttpIPDiscoverer) DiscoverIP(ctx context.Context, network *IPNetwork) (string, error) {
+    transport := &http.Transport{DialContext: network.Dial_}
+    defer transport.CloseIdleConnections()
+    client := &http.Client{Transport: transport, Timeout: _IPDiscoverTimeout}
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, self.Url_, nil)
+    if err != nil {
+        return "", err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+    if err != nil {
+        return "", err
+    }
+    ip := string(bytes.TrimSpace(body))
+    if resp.StatusCode != http.StatusOK || net.ParseIP(ip) == nil {
+        return "", fmt.Errorf("%s answered %s", self.Url_, resp.Status)
+    }
+    return ip, nil
+}
+
+// StunIPDiscoverer sends a stun binding request and reads the mapped
+// address. Through a tunnel only stun over tcp works.
+type StunIPDiscoverer struct {
+    Addr_    string
+    Network_ string
+}
+
+func (self *StunIPDiscoverer) DiscoverIP(ctx context.Context, network *IPNetwork) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, _IPDiscoverTimeout)
+    defer cancel()
+
+    conn, err := network.Dial_(ctx, self.Network_, self.Addr_)
+    if err != nil {
+        return "", err
+    }
+    defer conn.Close()
+    deadline, _ := ctx.Deadline()
+    _ = conn.SetDeadline(deadline)
+
+    request := make([]byte, 20)
+    binary.BigEndian.PutUint16(request[0:], _StunBindingRequest)
+    binary.BigEndian.PutUint32(request[4:], _StunMagicCookie)
+    _, err = rand.Read(request[8:20])
+    if err != nil {
+        return "", err
+    }
+    _, err = conn.Write(request)
+    if err != nil {
+        return "", err
+    }
+
+    response := make([]byte, 1500)
+    n, err := conn.Read(response)
+    if err != nil {
+        return "", err
+    }
+    if self.Network_ == "tcp" && n >= 4 {
+        // over tcp the message may come in pieces
+        size := 20 + int(binary.BigEndian.Uint16(response[2:4]))
+        if size <= len(response) && n < size {
+            _, err = io.ReadFull(conn, response[n:size])
+            if err != nil {
+                return "", err
+            }
+            n = size
+        }
+    }
+    return ParseStunResponse(response[:n], request[8:20])
+}
+
+func ParseStunResponse(msg []byte, transaction []byte) (string, error) {
+    if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != _StunBindingResponse ||
+        binary.BigEndian.Uint32(msg[4:]) != _StunMagicCookie || !bytes.Equal(msg[8:20], transaction) {
+        return "", errors.New("bad stun response")
+    }
+    size := int(binary.BigEndian.Uint16(msg[2:]))
+    if len(msg) < 20+size {
+        return "", errors.New("short stun response")
+    }
+
+    var mapped net.IP
+    attrs := msg[20 : 20+size]
+    for len(attrs) >= 4 {
+        kind := binary.BigEndian.Uint16(attrs[0:])
+        length := int(binary.BigEndian.Uint16(attrs[2:]))
+        if len(attrs) < 4+length {
+            break
+        }
+        value := attrs[4 : 4+length]
+        switch kind {
+        case _StunXorMappedAddr:
+            if ip := StunAddress(value, msg[4:20]); ip != nil {
+                return ip.String(), nil
+            }
+        case _StunMappedAddress:
+            mapped = StunAddress(value, nil)
+        }
+        // attributes are padded to 4 bytes
+        next := 4 + (length+3)&^3
+        if next > len(attrs) {
+            break
+        }
+        attrs = attrs[next:]
+    }
+    if mapped != nil {
+        return mapped.String(), nil
+    }
+    return "", errors.New("no mapped address in stun response")
+}
+
+// StunAddress reads an address attribute, xor is the magic cookie and
+// transaction id for XOR-MAPPED-ADDRESS.
+func StunAddress(value []byte, xor []byte) net.IP {
+    if len(value) < 4 {
+        return nil
+    }
+    var size int
+    switch value[1] {
+    case 0x01:
+        size = net.IPv4len
+    case 0x02:
+        size = net.IPv6len
+    default:
+        return nil
+    }
+    if len(value) < 4+size {
+        return nil
+    }
+    ip := make(net.IP, size)
+    copy(ip, value[4:4+size])
+    for i := range xor {
+        if i < size {
+            ip[i] ^= xor[i]
+        }
+    }
+    return ip
+}
+
+// AgentIPDiscoverer asks the agent, which looks its ip up with the echo
+// urls of the invocation payload from its own network.
+type AgentIPDiscoverer struct {
+}
+
+func (self *AgentIPDiscoverer) DiscoverIP(ctx context.Context, network *IPNetwork) (string, error) {
+    if network.OpenStream_ == nil {
+        return "", errors.New("no agent to ask")
+    }
+    stream, err := network.OpenStream_()
+    if err != nil {
+        return "", err
+    }
+    defer stream.Close()
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        deadline = time.Now().Add(2 * _IPDiscoverTimeout)
+    }
+    _ = stream.SetDeadline(deadline)
+
+    return wire.RequestIP(stream)
+}
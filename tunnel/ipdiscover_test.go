@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// the binding responses of RFC 5769 without MESSAGE-INTEGRITY and
+// FINGERPRINT, which aren't checked
+const (
+    _StunTransaction = "b7e7a701bc34d686fa87dfae"
+    _StunSoftware    = "8022000b" + "74657374" + "20766563" + "746f7220"
+)
+
+func StunFixture(t *testing.T, attrs ...string) []byte {
+    body, err := hex.DecodeString(strings.Join(attrs, ""))
+    if err != nil {
+        t.Fatal(err)
+    }
+    head, _ := hex.DecodeString(fmt.Sprintf("0101%04x2112a442", len(body)) + _StunTransaction)
+    return append(head, body...)
+}
+
+func TestParseStunResponse(t *testing.T) {
+    transaction, _ := hex.DecodeString(_StunTransaction)
+    xorMapped4 := "00200008" + "0001a147" + "e112a643"
+    xorMapped6 := "00200014" + "0002a147" + "0113a9fa" + "a5d3f179" + "bc25f4b5" + "bed2b9d9"
+    mapped4 := "00010008" + "00018055" + "c6336407"
+    mapped6 := "00010014" + "00028055" + "20010db8" + "00000000" + "00000000" + "00000001"
+
+    tests := []struct {
+        Name string
+        Msg  []byte
+        IP   string
+    }{
+        {"xor ipv4", StunFixture(t, _StunSoftware, xorMapped4), "192.0.2.1"},
+        {"xor ipv6", StunFixture(t, _StunSoftware, xorMapped6), "2001:db8:1234:5678:11:2233:4455:6677"},
+        {"mapped ipv4", StunFixture(t, _StunSoftware, mapped4), "198.51.100.7"},
+        {"mapped ipv6", StunFixture(t, mapped6), "2001:db8::1"},
+        // XOR-MAPPED-ADDRESS wins over MAPPED-ADDRESS in any order
+        {"mapped then xor", StunFixture(t, mapped4, xorMapped4), "192.0.2.1"},
+        {"xor then mapped", StunFixture(t, xorMapped6, mapped4), "2001:db8:1234:5678:11:2233:4455:6677"},
+        {"bad family", StunFixture(t, "00200008"+"0003a147"+"e112a643", mapped4), "198.51.100.7"},
+        {"no address", StunFixture(t, _StunSoftware), ""},
+        {"truncated attribute", StunFixture(t, "00200014"+"0002a147"+"0113a9fa"), ""},
+    }
+    for _, test := range tests {
+        ip, err := ParseStunResponse(test.Msg, transaction)
+        if ip != test.IP || (err == nil) != (test.IP != "") {
+            t.Errorf("%s: %q %v, want %q", test.Name, ip, err, test.IP)
+        }
+    }
+
+    valid := StunFixture(t, _StunSoftware, xorMapped4)
+    flip := func(i int, b byte) []byte {
+        msg := append([]byte{}, valid...)
+        msg[i] ^= b
+        return msg
+    }
+    bad := map[string][]byte{
+        "short header":      valid[:19],
+        "short body":        valid[:len(valid)-1],
+        "request":           flip(0, 0x01),
+        "error response":    flip(1, 0x10),
+        "no magic cookie":   flip(4, 0xff),
+        "other transaction": flip(19, 0x01),
+    }
+    for name, msg := range bad {
+        if ip, err := ParseStunResponse(msg, transaction); err == nil {
+            t.Errorf("%s: accepted as %s", name, ip)
+        }
+    }
+}
+
+func TestParseIPDiscoverer(t *testing.T) {
+    tests := []struct {
+        Spec  string
+        Kind  string
+        Echo  string
+        Agent bool
+    }{
+        {"none", "*tunnel.StaticIPDiscoverer", "", false},
+        {"static:192.0.2.1", "*tunnel.StaticIPDiscoverer", "", false},
+        {"static:2001:db8::1", "*tunnel.StaticIPDiscoverer", "", false},
+        {"agent", "*tunnel.AgentIPDiscoverer", "", true},
+        {"https://checkip.amazonaws.com", "*tunnel.HttpIPDiscoverer", "https://checkip.amazonaws.com", false},
+        {"stun://stun.example.com:3478", "*tunnel.StunIPDiscoverer", "", false},
+        {"stun+tcp://[2001:db8::1]:3478", "*tunnel.StunIPDiscoverer", "", false},
+        {DefaultIPDiscovery, "tunnel.FallbackIPDiscoverer", DefaultIPDiscovery, false},
+        {" http://a.example.com/ip , agent,,static:192.0.2.1", "tunnel.FallbackIPDiscoverer", "http://a.example.com/ip", true},
+    }
+    for _, test := range tests {
+        d, err := ParseIPDiscoverer(test.Spec)
+        if err != nil {
+            t.Errorf("%s: %v", test.Spec, err)
+            continue
+        }
+        if kind := fmt.Sprintf("%T", d); kind != test.Kind {
+            t.Errorf("%s: %s, want %s", test.Spec, kind, test.Kind)
+        }
+        if echo := strings.Join(EchoUrls(d), ","); echo != test.Echo {
+            t.Errorf("%s: echo urls %s, want %s", test.Spec, echo, test.Echo)
+        }
+        if UsesAgent(d) != test.Agent {
+            t.Errorf("%s: uses agent %v", test.Spec, !test.Agent)
+        }
+    }
+
+    if d, _ := ParseIPDiscoverer("stun+tcp://stun.example.com:3478"); d.(*StunIPDiscoverer).Network_ != "tcp" {
+        t.Error("stun+tcp not over tcp")
+    }
+    if d, _ := ParseIPDiscoverer("stun://stun.example.com:3478"); d.(*StunIPDiscoverer).Network_ != "udp" {
+        t.Error("stun not over udp")
+    }
+
+    bad := []string{
+        "",
+        " , ",
+        "static:",
+        "static:example.com",
+        "stun://stun.example.com",
+        "stun+udp://stun.example.com:3478",
+        "ftp://example.com",
+        "checkip.amazonaws.com",
+        "https://checkip.amazonaws.com,nope",
+    }
+    for _, spec := range bad {
+        if _, err := ParseIPDiscoverer(spec); err == nil {
+            t.Errorf("%q accepted", spec)
+        }
+    }
+}
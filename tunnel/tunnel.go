@@ -0,0 +1,599 @@
+// Package tunnel invokes the agents, accepts the ssh tunnels they open back
+// and hands out yamux streams through them.
+package tunnel
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os/user"
+    "path"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/ginuerzh/gost"
+    "github.com/hashicorp/yamux"
+    "lambdaproxy/backend"
+    "lambdaproxy/wire"
+)
+
+const (
+    _HandshakeTimeout = 10 * time.Second
+)
+
+// Backend runs the agents, backend.AwsLambda invokes them as lambda
+// functions.
+type Backend interface {
+    Acquire(ctx context.Context) (*backend.LambdaTarget, error)
+    Release(target *backend.LambdaTarget, err error)
+    Invoke(ctx context.Context, target *backend.LambdaTarget, payload []byte) error
+    Redeploy(ctx context.Context, target *backend.LambdaTarget) error
+    Regions() []string
+}
+
+type TunnelConnection struct {
+    Id_      uint64
+    Conn_    net.Conn
+    Sess_    *yamux.Session
+    Time_    time.Time
+    Account_ string
+    Region_  string
+    ExitIP_  string
+}
+
+type Tunnel struct {
+    SSHAddr_       string
+    SSHUser_       string
+    SSHKey_        *SSHKey
+    LambdaHandler_ Backend
+    ExitIP_        IPDiscoverer
+    Egress_        *wire.EgressPolicy
+    Headers_       *wire.HeaderPolicy
+    Upstream_      []string
+    DirectUdp_     bool
+    AgentMode_     string
+    AgentForward_  string
+    TunnelMutex_   sync.RWMutex
+    TunnelConns_   []*TunnelConnection
+    Sessions_      map[*TunnelConnection]bool
+    LambdaIPs_     map[string]int
+    ConnNum_       uint64
+    ReqNum_        uint64
+    ConnTimeoutS_  int64
+    Size_          int64
+    Running_       atomic.Bool
+    Closed_        bool
+}
+
+func (self *Tunnel) SetEgressPolicy(egress *wire.EgressPolicy) {
+    self.Egress_ = egress
+}
+
+func (self *Tunnel) SetHeaderPolicy(headers *wire.HeaderPolicy) {
+    self.Headers_ = headers
+}
+
+// SetUpstream makes the agents dial through the chain of proxy urls, after
+// ParseUpstream checked them. Udp and dns can't follow, directUdp lets them
+// leave the lambda directly, otherwise they are refused.
+func (self *Tunnel) SetUpstream(upstream []string, directUdp bool) {
+    self.Upstream_ = upstream
+    self.DirectUdp_ = directUdp
+}
+
+// UdpAllowed tells whether the agents relay udp and dns.
+func (self *Tunnel) UdpAllowed() bool {
+    return len(self.Upstream_) == 0 || self.DirectUdp_
+}
+
+// SetAgentMode picks the protocol the agents serve on the tunnel streams:
+// http, socks5, auto or forward to a fixed target.
+func (self *Tunnel) SetAgentMode(mode string, forward string) error {
+    switch mode {
+    case wire.ModeHttp, wire.ModeSocks5, wire.ModeAuto:
+    case wire.ModeForward:
+        if forward == "" {
+            return fmt.Errorf("agent mode %s needs a forward target", mode)
+        }
+    default:
+        return fmt.Errorf("unknown agent mode %q", mode)
+    }
+    self.AgentMode_ = mode
+    self.AgentForward_ = forward
+    return nil
+}
+
+// Connect invokes one lambda. Every invocation gets its own tunnel listener
+// so the session it opens is known to run in the invoked account and region.
+func (self *Tunnel) Connect(ctx context.Context) {
+    target, err := self.LambdaHandler_.Acquire(ctx)
+    if err != nil {
+        if !errors.Is(err, context.Canceled) {
+            log.Printf("failed to acquire a lambda: %v", err)
+        }
+        return
+    }
+
+    tunnelListen, err := net.Listen("tcp", "")
+    if err != nil {
+        self.LambdaHandler_.Release(target, err)
+        log.Printf("failed to start tunnel listener: %v", err)
+        return
+    }
+    defer tunnelListen.Close()
+    log.Printf("tunnel listen: %s for account=%s region=%s", tunnelListen.Addr().String(), target.Account_.Name_, target.Region_)
+
+    req := &wire.Request{
+        Version:  wire.Version,
+        Host:     self.SSHAddr_,
+        Tunnel:   net.JoinHostPort("localhost", strconv.Itoa(tunnelListen.Addr().(*net.TCPAddr).Port)),
+        Key:      self.SSHKey_.GetPrivate(),
+        User:     self.SSHUser_,
+        Egress:   self.Egress_,
+        Mode:     self.AgentMode_,
+        Forward:  self.AgentForward_,
+        Headers:  self.Headers_,
+        Upstream: self.Upstream_,
+    }
+    if len(self.Upstream_) > 0 {
+        req.DirectUdp = self.DirectUdp_
+    }
+    if UsesAgent(self.ExitIP_) {
+        req.IPUrls = EchoUrls(self.ExitIP_)
+        if len(req.IPUrls) == 0 {
+            req.IPUrls = SplitList(DefaultIPDiscovery)
+        }
+    }
+    req.Capabilities = req.Required()
+
+    go self.AcceptTunnel(ctx, tunnelListen, target, req.Capabilities)
+
+    payload, err := json.Marshal(req)
+    if err != nil {
+        log.Fatalf("unable to marshal request: %v", err)
+    }
+
+    err = self.LambdaHandler_.Invoke(ctx, target, payload)
+    if err != nil && ctx.Err() == nil {
+        log.Printf("lambda invoke failed: %v", err)
+    }
+}
+
+func (self *Tunnel) Close() error {
+    log.Println("Tunnel Invalidate")
+    err := self.SSHKey_.Invalidate()
+    if err != nil {
+        log.Printf("unable to revoke ssh key: %v", err)
+    }
+
+    self.TunnelMutex_.Lock()
+    self.Closed_ = true
+    self.TunnelMutex_.Unlock()
+
+    self.TunnelMutex_.RLock()
+    for v := range self.Sessions_ {
+        log.Println(v.Conn_.RemoteAddr().String() + " close")
+        v.Sess_.Close()
+    }
+    self.TunnelMutex_.RUnlock()
+
+    return err
+}
+
+// Shutdown asks every connected agent to exit so the lambdas stop billing,
+// then closes the sessions and revokes the ssh key.
+func (self *Tunnel) Shutdown(timeout time.Duration) error {
+    self.TunnelMutex_.Lock()
+    self.Closed_ = true
+    conns := make([]*TunnelConnection, 0, len(self.Sessions_))
+    for v := range self.Sessions_ {
+        conns = append(conns, v)
+    }
+    self.TunnelMutex_.Unlock()
+
+    var wg sync.WaitGroup
+    for _, conn := range conns {
+        wg.Add(1)
+        go func(conn *TunnelConnection) {
+            defer wg.Done()
+            err := self.StopAgent(conn, timeout)
+            if err != nil {
+                log.Printf("unable to stop agent %s: %v", conn.Conn_.RemoteAddr().String(), err)
+            }
+        }(conn)
+    }
+    wg.Wait()
+
+    return self.Close()
+}
+
+func (self *Tunnel) StopAgent(conn *TunnelConnection, timeout time.Duration) error {
+    stream, err := conn.Sess_.OpenStream()
+    if err != nil {
+        return err
+    }
+    defer stream.Close()
+    _ = stream.SetDeadline(time.Now().Add(timeout))
+
+    req, err := wire.WriteControlRequest(stream, wire.ExitPath)
+    if err != nil {
+        return err
+    }
+
+    resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("agent answered %s", resp.Status)
+    }
+    log.Println("Agent exited", conn.Conn_.RemoteAddr().String())
+    return nil
+}
+
+func (self *Tunnel) RunConnTrigger(ctx context.Context) {
+    for {
+        for {
+            if self.Running_.Load() {
+                break
+            }
+            log.Printf("waitting connect...")
+            if backend.SleepContext(ctx, time.Second) != nil {
+                return
+            }
+        }
+        log.Printf("trigger lambda %d", self.ConnTimeoutS_)
+        go self.Connect(ctx)
+        if backend.SleepContext(ctx, time.Second*time.Duration(self.ConnTimeoutS_)) != nil {
+            return
+        }
+    }
+}
+
+// StreamConnector opens the proxy streams to agents of mode with a stream
+// header, except in the forward mode, where the agent only reaches its one
+// target. The other modes only pick how an agent answers streams without a
+// header, which this server doesn't open.
+func StreamConnector(mode string) gost.Connector {
+    if mode == wire.ModeForward {
+        return gost.ForwardConnector()
+    }
+    return &DialConnector{}
+}
+
+// DialConnector opens a stream with a stream header, the agent dials the
+// target whatever its mode and replies whether it could. User_ and Flags_
+// go in the header.
+type DialConnector struct {
+    User_  string
+    Flags_ byte
+}
+
+func (self *DialConnector) Connect(conn net.Conn, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    return self.ConnectContext(context.Background(), conn, "tcp", address, options...)
+}
+
+func (self *DialConnector) ConnectContext(ctx context.Context, conn net.Conn, network, address string, options ...gost.ConnectOption) (net.Conn, error) {
+    if deadline, ok := ctx.Deadline(); ok {
+        _ = conn.SetDeadline(deadline)
+        defer conn.SetDeadline(time.Time{})
+    }
+    err := wire.WriteStreamHeader(conn, &wire.StreamHeader{Target: address, User: self.User_, Flags: self.Flags_})
+    if err != nil {
+        return nil, err
+    }
+    err = wire.ReadDialReply(conn)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", address, err)
+    }
+    return conn, nil
+}
+
+// SetExitIPDiscoverer picks how the exit ip of every new tunnel is found.
+func (self *Tunnel) SetExitIPDiscoverer(exitIP IPDiscoverer) {
+    self.ExitIP_ = exitIP
+}
+
+// ConnIPNetwork dials from the agent of conn with a stream header. The
+// forward mode can only reach its one target.
+func (self *Tunnel) ConnIPNetwork(conn *TunnelConnection) *IPNetwork {
+    return &IPNetwork{
+        Dial_: func(ctx context.Context, network, address string) (net.Conn, error) {
+            if network != "tcp" || self.AgentMode_ == wire.ModeForward {
+                return nil, fmt.Errorf("cannot dial %s %s through the agent", network, address)
+            }
+            stream, err := conn.Sess_.OpenStream()
+            if err != nil {
+                return nil, err
+            }
+            cc, err := StreamConnector(self.AgentMode_).ConnectContext(ctx, stream, network, address)
+            if err != nil {
+                stream.Close()
+                return nil, err
+            }
+            return cc, nil
+        },
+        OpenStream_: func() (net.Conn, error) {
+            return conn.Sess_.OpenStream()
+        },
+    }
+}
+
+func (self *Tunnel) GetExitIP(conn *TunnelConnection) (string, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    return self.ExitIP_.DiscoverIP(ctx, self.ConnIPNetwork(conn))
+}
+
+// Handshake asks a new agent for its protocol version and capabilities.
+func (self *Tunnel) Handshake(conn *TunnelConnection, required []string) error {
+    stream, err := conn.Sess_.OpenStream()
+    if err != nil {
+        return err
+    }
+    defer stream.Close()
+    _ = stream.SetDeadline(time.Now().Add(_HandshakeTimeout))
+
+    hello, err := wire.RequestHello(stream)
+    if err != nil {
+        return err
+    }
+    return hello.Check(required)
+}
+
+// AcceptTunnel waits for the one connection the invoked lambda makes back
+// through ssh, until the invocation ends and the listener is closed. An
+// agent failing the handshake is dropped, an outdated one redeployed.
+func (self *Tunnel) AcceptTunnel(ctx context.Context, tunnelListen net.Listener, target *backend.LambdaTarget, required []string) {
+    c, err := tunnelListen.Accept()
+    if err != nil {
+        if !errors.Is(err, net.ErrClosed) {
+            log.Println("Failed to accept tunnel connection:", err)
+        }
+        return
+    }
+    log.Println("Accepted tunnel connection from", c.RemoteAddr())
+
+    tunnelSession, err := yamux.Client(c, nil)
+    if err != nil {
+        log.Println("Failed to start session inside tunnel")
+        c.Close()
+        return
+    }
+    log.Println("Established session to", tunnelSession.RemoteAddr())
+
+    conn := &TunnelConnection{
+        Id_:      atomic.AddUint64(&self.ConnNum_, 1),
+        Conn_:    c,
+        Sess_:    tunnelSession,
+        Time_:    time.Now(),
+        Account_: target.Account_.Name_,
+        Region_:  target.Region_,
+    }
+
+    err = self.Handshake(conn, required)
+    if err != nil {
+        log.Printf("agent handshake failed in account=%s region=%s: %v", conn.Account_, conn.Region_, err)
+        tunnelSession.Close()
+        if errors.Is(err, wire.ErrOutdated) {
+            err = self.LambdaHandler_.Redeploy(ctx, target)
+            if err != nil {
+                log.Printf("unable to redeploy agent: %v", err)
+            }
+        }
+        return
+    }
+
+    externalIP, err := self.GetExitIP(conn)
+    if err != nil {
+        log.Println("Failed to check ip address:", err)
+    }
+
+    self.TunnelMutex_.Lock()
+    if self.Closed_ {
+        self.TunnelMutex_.Unlock()
+        tunnelSession.Close()
+        return
+    }
+    conn.ExitIP_ = externalIP
+    if externalIP != "" {
+        self.LambdaIPs_[externalIP] += 1
+    }
+    self.TunnelConns_ = append(self.TunnelConns_, conn)
+    self.Sessions_[conn] = true
+
+    log.Println("---------------")
+    log.Printf("Current Lambda IP Address: %s (account=%s, region=%s)", externalIP, conn.Account_, conn.Region_)
+    log.Println("Active Lambda Tunnel Count: ", len(self.TunnelConns_))
+    count := 1
+    for _, v := range self.TunnelConns_ {
+        log.Printf("Lambda Tunnel #%v\n", count)
+        log.Println("   Connection ID: " + strconv.FormatUint(v.Id_, 10) + " " + v.Conn_.RemoteAddr().String())
+        log.Println("   Region: " + v.Region_)
+        log.Println("   Start Time: " + v.Time_.Format("2006-01-02T15:04:05"))
+        log.Println("   Active Streams: " + strconv.Itoa(v.Sess_.NumStreams()))
+        count++
+    }
+    log.Printf("%v Unique Lambda IPs Used So Far\n", len(self.LambdaIPs_))
+    log.Println("---------------")
+    self.TunnelMutex_.Unlock()
+
+    go self.PingConn(conn)
+}
+
+func (self *Tunnel) RemoveConn(conn *TunnelConnection, isClose bool) {
+    self.TunnelMutex_.Lock()
+    for k, v := range self.TunnelConns_ {
+        if conn == v {
+            log.Println("Removing tunnel", conn.Conn_.RemoteAddr().String())
+            self.TunnelConns_ = append(self.TunnelConns_[:k], self.TunnelConns_[k+1:]...)
+            break
+        }
+    }
+    self.TunnelMutex_.Unlock()
+
+    if isClose {
+        log.Println("Close tunnel", conn.Conn_.RemoteAddr().String())
+        err := conn.Sess_.Close()
+        if err != nil {
+            log.Printf("error close connID=%v: %v", conn.Conn_.RemoteAddr().String(), err)
+        }
+    }
+}
+
+func InRegions(region string, regions []string) bool {
+    if len(regions) == 0 {
+        return true
+    }
+    for _, v := range regions {
+        if v == region {
+            return true
+        }
+    }
+    return false
+}
+
+// PickConn rotates over the live tunnels in one of regions, any region if
+// regions is empty.
+func (self *Tunnel) PickConn(regions []string) *TunnelConnection {
+    self.TunnelMutex_.Lock()
+    defer self.TunnelMutex_.Unlock()
+
+    size := uint64(len(self.TunnelConns_))
+    for i := uint64(0); i < size; i++ {
+        conn := self.TunnelConns_[(self.ReqNum_+i)%size]
+        if InRegions(conn.Region_, regions) {
+            self.ReqNum_ += i + 1
+            return conn
+        }
+    }
+    return nil
+}
+
+// GetStream opens a stream on a tunnel in one of regions, waiting for one to
+// come up until ctx is done. It fails right away if no account deploys to
+// those regions.
+func (self *Tunnel) GetStream(ctx context.Context, regions []string) (*yamux.Stream, *TunnelConnection, error) {
+    served := false
+    for _, region := range self.LambdaHandler_.Regions() {
+        served = served || InRegions(region, regions)
+    }
+    if !served {
+        return nil, nil, fmt.Errorf("no lambda deployed in regions %v", regions)
+    }
+
+    for {
+        nowConn := self.PickConn(regions)
+        if nowConn != nil {
+            stream, err := nowConn.Sess_.OpenStream()
+            return stream, nowConn, err
+        }
+
+        self.TunnelMutex_.RLock()
+        closed := self.Closed_
+        self.TunnelMutex_.RUnlock()
+        if closed {
+            return nil, nil, errors.New("tunnel closed")
+        }
+
+        log.Println("wait ready...")
+        if err := backend.SleepContext(ctx, time.Second); err != nil {
+            return nil, nil, err
+        }
+    }
+}
+
+func (self *Tunnel) PingConn(conn *TunnelConnection) {
+    for {
+        _, err := conn.Sess_.Ping()
+        if err != nil {
+            if time.Since(conn.Time_).Seconds() < float64(self.ConnTimeoutS_-2) {
+                log.Println("Close early")
+            }
+            self.RemoveConn(conn, true)
+            self.TunnelMutex_.Lock()
+            delete(self.Sessions_, conn)
+            self.TunnelMutex_.Unlock()
+            break
+        }
+        if time.Since(conn.Time_).Seconds() > float64(self.ConnTimeoutS_) {
+            self.RemoveConn(conn, false)
+        }
+        time.Sleep(time.Millisecond * 300)
+    }
+}
+
+// NewTunnel finds the public ip the agents reach this host at with
+// serverIP and adds a key for them to the current user.
+func NewTunnel(awslambdaHandler Backend, size int64, sshPort string, connTimeoutS int64, serverIP IPDiscoverer) (*Tunnel, error) {
+    var tunnel = NewTunnelSSH(awslambdaHandler, size, connTimeoutS, "", "", nil)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    hostIP, err := serverIP.DiscoverIP(ctx, LocalIPNetwork())
+    cancel()
+    if err == nil && hostIP == "" {
+        err = errors.New("no server ip discovery")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("cant get ip: %w", err)
+    }
+    log.Printf("public ip: %s", hostIP)
+
+    curUser, err := user.Current()
+    if err != nil {
+        return nil, fmt.Errorf("cant get current user: %w", err)
+    }
+    log.Printf("current user: %s", curUser.Username)
+
+    pk, err := NewSSHKey(path.Join(curUser.HomeDir, ".ssh/authorized_keys"))
+    if err != nil {
+        return nil, fmt.Errorf("cant initialize ssh key: %w", err)
+    }
+
+    tunnel.SSHAddr_ = net.JoinHostPort(hostIP, "22")
+    tunnel.SSHUser_ = curUser.Username
+    tunnel.SSHKey_ = pk
+
+    return tunnel, nil
+}
+
+// NewTunnelSSH sets up a tunnel the agents reach at sshAddr, logging in as
+// sshUser with sshKey, without looking up the public ip or the current
+// user.
+func NewTunnelSSH(awslambdaHandler Backend, size int64, connTimeoutS int64, sshAddr string, sshUser string, sshKey *SSHKey) *Tunnel {
+    var tunnel = new(Tunnel)
+    tunnel.TunnelConns_ = make([]*TunnelConnection, 0)
+    tunnel.Sessions_ = make(map[*TunnelConnection]bool)
+    tunnel.LambdaIPs_ = make(map[string]int)
+
+    tunnel.LambdaHandler_ = awslambdaHandler
+    tunnel.ExitIP_, _ = ParseIPDiscoverer(DefaultIPDiscovery)
+    tunnel.SSHAddr_ = sshAddr
+    tunnel.SSHUser_ = sshUser
+    tunnel.SSHKey_ = sshKey
+    tunnel.ConnTimeoutS_ = connTimeoutS
+    tunnel.Size_ = size
+    tunnel.ReqNum_ = 0
+    tunnel.AgentMode_ = wire.ModeHttp
+    tunnel.Running_.Store(true)
+
+    return tunnel
+}
+
+func (self *Tunnel) Run(ctx context.Context) {
+    for i := 0; i < int(self.Size_); i++ {
+        log.Println("start tunnel ", i)
+        go self.RunConnTrigger(ctx)
+        if backend.SleepContext(ctx, time.Second*3) != nil {
+            return
+        }
+    }
+}
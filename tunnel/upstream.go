@@ -0,0 +1,33 @@
+package tunnel
+
+import (
+    "fmt"
+
+    "github.com/ginuerzh/gost"
+)
+
+// ParseUpstream validates the chain of proxies the agents dial through, an
+// agent would only fail on it after being invoked. Hops are gost node urls
+// of http and socks5 proxies, plain or over tls, with their credentials.
+func ParseUpstream(urls []string) ([]string, error) {
+    for i, v := range urls {
+        node, err := gost.ParseNode(v)
+        if err != nil {
+            return nil, fmt.Errorf("upstream %d: gost.ParseNode: %+v", i+1, err)
+        }
+        switch node.Protocol {
+        case "http", "socks5":
+        default:
+            return nil, fmt.Errorf("upstream %s: unsupported protocol %q, use http or socks5", node.Addr, node.Protocol)
+        }
+        switch node.Transport {
+        case "tcp", "tls":
+        default:
+            return nil, fmt.Errorf("upstream %s: unsupported transport %q, use tcp or tls", node.Addr, node.Transport)
+        }
+        if node.Addr == "" {
+            return nil, fmt.Errorf("upstream %d: no address", i+1)
+        }
+    }
+    return urls, nil
+}
@@ -0,0 +1,148 @@
+package wire
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+)
+
+const (
+    // StreamHeaderMagic starts a stream the agent dials the target of
+    // itself, no proxy protocol or control request starts with it.
+    StreamHeaderMagic = 0x00
+
+    // the header is the magic, the 2 byte length of its fields and the
+    // fields, each a type byte, a 2 byte length and the value. Agents skip
+    // the fields they don't know.
+    _FieldTarget = 0x01
+    _FieldUser   = 0x02
+    _FieldFlags  = 0x03
+
+    // FlagRaw marks a connection the client opened without a proxy
+    // protocol, redirected to a transparent listener or to a forward.
+    FlagRaw = 0x01
+    // FlagHttp marks a stream carrying plain http requests, the agent
+    // applies the header policy to them.
+    FlagHttp = 0x02
+
+    DialOk     = 0x00
+    DialDenied = 0x01
+    DialFailed = 0x02
+)
+
+var (
+    ErrDialDenied = errors.New("agent denied the target")
+    ErrDialFailed = errors.New("agent could not dial the target")
+)
+
+// StreamHeader tells the agent where to dial, in place of a proxy protocol
+// handshake, and which user the server authenticated for its logs. The
+// server terminates the client's proxy protocol, so it routes and accounts
+// the connection before the stream is opened.
+type StreamHeader struct {
+    Target string
+    User   string
+    Flags  byte
+}
+
+func WriteStreamHeader(w io.Writer, header *StreamHeader) error {
+    var fields []byte
+    fields = AppendField(fields, _FieldTarget, header.Target)
+    if header.User != "" {
+        fields = AppendField(fields, _FieldUser, header.User)
+    }
+    if header.Flags != 0 {
+        fields = AppendField(fields, _FieldFlags, string([]byte{header.Flags}))
+    }
+    if len(fields) > 0xffff {
+        return errors.New("stream header too large")
+    }
+
+    frame := append([]byte{StreamHeaderMagic}, byte(len(fields)>>8), byte(len(fields)))
+    _, err := w.Write(append(frame, fields...))
+    return err
+}
+
+func AppendField(fields []byte, kind byte, value string) []byte {
+    fields = append(fields, kind)
+    fields = binary.BigEndian.AppendUint16(fields, uint16(len(value)))
+    return append(fields, value...)
+}
+
+// PeekStreamHeader tells whether the stream starts with a header.
+func PeekStreamHeader(reader *bufio.Reader) bool {
+    head, err := reader.Peek(1)
+    return err == nil && head[0] == StreamHeaderMagic
+}
+
+func ReadStreamHeader(r io.Reader) (*StreamHeader, error) {
+    var head [3]byte
+    _, err := io.ReadFull(r, head[:])
+    if err != nil {
+        return nil, err
+    }
+    if head[0] != StreamHeaderMagic {
+        return nil, errors.New("no stream header")
+    }
+    fields := make([]byte, binary.BigEndian.Uint16(head[1:]))
+    _, err = io.ReadFull(r, fields)
+    if err != nil {
+        return nil, err
+    }
+
+    header := new(StreamHeader)
+    for len(fields) > 0 {
+        if len(fields) < 3 {
+            return nil, errors.New("bad stream header")
+        }
+        kind := fields[0]
+        size := int(binary.BigEndian.Uint16(fields[1:]))
+        if len(fields) < 3+size {
+            return nil, errors.New("bad stream header")
+        }
+        value := string(fields[3 : 3+size])
+        fields = fields[3+size:]
+
+        switch kind {
+        case _FieldTarget:
+            header.Target = value
+        case _FieldUser:
+            header.User = value
+        case _FieldFlags:
+            // later versions may use more bytes, the first is known
+            if len(value) > 0 {
+                header.Flags = value[0]
+            }
+        }
+    }
+    if header.Target == "" {
+        return nil, errors.New("stream header without target")
+    }
+    return header, nil
+}
+
+// WriteDialReply answers a stream header with one of the Dial codes, the
+// stream carries the connection after DialOk.
+func WriteDialReply(w io.Writer, code byte) error {
+    _, err := w.Write([]byte{code})
+    return err
+}
+
+func ReadDialReply(r io.Reader) error {
+    var code [1]byte
+    _, err := io.ReadFull(r, code[:])
+    if err != nil {
+        return err
+    }
+    switch code[0] {
+    case DialOk:
+        return nil
+    case DialDenied:
+        return ErrDialDenied
+    case DialFailed:
+        return ErrDialFailed
+    }
+    return fmt.Errorf("%w: reply %d", ErrDialFailed, code[0])
+}
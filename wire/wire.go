@@ -0,0 +1,355 @@
+// Package wire is the protocol between the server and the lambda agent: the
+// invocation payload, the handshake the server runs on every new tunnel and
+// the control requests and stream header streams may start with.
+//
+// Version 1 agents predate the handshake, they don't answer the hello
+// request and read the ssh host and the tunnel address under the json names
+// "address" and "string", so they no longer find them in the payload.
+package wire
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+)
+
+const (
+    Version    = 2
+    MinVersion = 2
+
+    ModeHttp    = "http"
+    ModeSocks5  = "socks5"
+    ModeAuto    = "auto"
+    ModeForward = "forward"
+
+    // CapEgress, CapHeaders and CapUpstream are an agent enforcing the
+    // egress and header policies and dialing through an upstream chain, the
+    // other capabilities are the modes and the control requests it serves.
+    CapEgress   = "egress"
+    CapExit     = "exit"
+    CapIP       = "ip"
+    CapUdp      = "udp"
+    CapDns      = "dns"
+    CapDial     = "dial"
+    CapHeaders  = "headers"
+    CapUpstream = "upstream"
+
+    ControlHost = "lambdaproxy"
+    HelloPath   = "/__lambdaproxy/hello"
+    ExitPath    = "/__lambdaproxy/exit"
+    IPPath      = "/__lambdaproxy/ip"
+    UdpPath     = "/__lambdaproxy/udp"
+    DnsPath     = "/__lambdaproxy/dns"
+
+    // a datagram frame is the length of the address, the address, the
+    // length of the data and the data, lengths are 2 bytes big endian
+    MaxDatagramSize = 65535
+)
+
+var (
+    ErrOutdated      = errors.New("outdated agent")
+    ErrControlFailed = errors.New("control request failed")
+    ErrUdpBypass     = errors.New("udp and dns would leave the lambda directly, bypassing the upstream")
+)
+
+// EgressPolicy tells the agent which targets it may dial. Empty allow lists
+// allow everything not denied.
+type EgressPolicy struct {
+    DenyCidrs    []string `json:"deny_cidrs"`
+    AllowDomains []string `json:"allow_domains"`
+    AllowPorts   []string `json:"allow_ports"`
+}
+
+// HeaderPolicy tells the agent which headers to remove from plain http
+// requests besides the hop-by-hop ones, and the User-Agent to send in place
+// of the client's if set.
+type HeaderPolicy struct {
+    Strip     []string `json:"strip"`
+    UserAgent string   `json:"user_agent,omitempty"`
+}
+
+// Request is the invocation payload. Capabilities lists what the server
+// needs from the agent for this invocation, IPUrls are the echo services
+// the agent asks for its public ip. Upstream is the chain of gost node urls
+// of http and socks5 proxies the agent dials its tcp targets through, udp
+// and dns are only served besides it with DirectUdp.
+type Request struct {
+    Version      int           `json:"version"`
+    Capabilities []string      `json:"capabilities,omitempty"`
+    Host         string        `json:"host"`
+    Tunnel       string        `json:"tunnel"`
+    Key          string        `json:"key"`
+    User         string        `json:"user"`
+    Egress       *EgressPolicy `json:"egress,omitempty"`
+    Mode         string        `json:"mode,omitempty"`
+    Forward      string        `json:"forward,omitempty"`
+    IPUrls       []string      `json:"ip_urls,omitempty"`
+    Headers      *HeaderPolicy `json:"headers,omitempty"`
+    Upstream     []string      `json:"upstream,omitempty"`
+    DirectUdp    bool          `json:"direct_udp,omitempty"`
+}
+
+// Required lists the capabilities the request depends on.
+func (self *Request) Required() []string {
+    caps := []string{ModeName(self.Mode), CapExit, CapDial}
+    if self.Egress != nil {
+        caps = append(caps, CapEgress)
+    }
+    if len(self.IPUrls) > 0 {
+        caps = append(caps, CapIP)
+    }
+    if self.Headers != nil {
+        caps = append(caps, CapHeaders)
+    }
+    if len(self.Upstream) > 0 {
+        caps = append(caps, CapUpstream)
+    }
+    return caps
+}
+
+// IPReport is the agent's answer to the ip request.
+type IPReport struct {
+    IP string `json:"ip"`
+}
+
+// Hello is the agent's answer to the handshake.
+type Hello struct {
+    Version      int      `json:"version"`
+    Capabilities []string `json:"capabilities"`
+}
+
+func (self *Hello) Has(capability string) bool {
+    for _, v := range self.Capabilities {
+        if v == capability {
+            return true
+        }
+    }
+    return false
+}
+
+// Check tells whether the agent can serve a request needing required. A
+// newer agent is fine as long as it still speaks MinVersion.
+func (self *Hello) Check(required []string) error {
+    if self.Version < MinVersion {
+        return fmt.Errorf("%w: protocol version %d, need %d", ErrOutdated, self.Version, MinVersion)
+    }
+    for _, capability := range required {
+        if !self.Has(capability) {
+            return fmt.Errorf("%w: no %s capability", ErrOutdated, capability)
+        }
+    }
+    return nil
+}
+
+func ModeName(mode string) string {
+    if mode == "" {
+        return ModeHttp
+    }
+    return mode
+}
+
+// ControlRequestLine is how a control request starts on a stream. Proxy
+// requests never start with an origin-form GET.
+func ControlRequestLine(path string) string {
+    return "GET " + path + " "
+}
+
+// PeekControl returns the control path a stream starts with, "" for a proxy
+// stream. Socks greetings are shorter than the request lines, so it only
+// peeks further after a 'G'.
+func PeekControl(reader *bufio.Reader) string {
+    head, err := reader.Peek(1)
+    if err != nil || head[0] != 'G' {
+        return ""
+    }
+    for _, path := range []string{HelloPath, ExitPath, IPPath, UdpPath, DnsPath} {
+        line := ControlRequestLine(path)
+        head, err = reader.Peek(len(line))
+        if err == nil && string(head) == line {
+            return path
+        }
+    }
+    return ""
+}
+
+// WriteControlRequest sends a control request on a fresh stream.
+func WriteControlRequest(w io.Writer, path string) (*http.Request, error) {
+    req, err := http.NewRequest(http.MethodGet, "http://"+ControlHost+path, nil)
+    if err != nil {
+        return nil, err
+    }
+    return req, req.Write(w)
+}
+
+// WriteResponse answers a control request, body may be nil.
+func WriteResponse(w io.Writer, body []byte) error {
+    _, err := io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: "+
+        strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+    return err
+}
+
+// WriteJson answers a control request with v.
+func WriteJson(w io.Writer, v interface{}) error {
+    body, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return WriteResponse(w, body)
+}
+
+// WriteError answers a control request the agent failed.
+func WriteError(w io.Writer, err error) error {
+    _, werr := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: "+
+        strconv.Itoa(len(err.Error()))+"\r\n\r\n"+err.Error())
+    return werr
+}
+
+func WriteHello(w io.Writer, hello *Hello) error {
+    return WriteJson(w, hello)
+}
+
+// RequestJson sends a control request on a fresh stream and decodes the
+// answer into v. An answer that isn't one is ErrControlFailed.
+func RequestJson(stream io.ReadWriter, path string, v interface{}) error {
+    req, err := WriteControlRequest(stream, path)
+    if err != nil {
+        return err
+    }
+    resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("%w: %s answered %s: %s", ErrControlFailed, path, resp.Status, body)
+    }
+    err = json.NewDecoder(resp.Body).Decode(v)
+    if err != nil {
+        return fmt.Errorf("%w: bad answer to %s: %v", ErrControlFailed, path, err)
+    }
+    return nil
+}
+
+// RequestHello runs the handshake on a fresh stream. Anything but a hello
+// answer, like the error page of a version 1 http agent, is ErrOutdated.
+func RequestHello(stream io.ReadWriter) (*Hello, error) {
+    hello := new(Hello)
+    err := RequestJson(stream, HelloPath, hello)
+    if errors.Is(err, ErrControlFailed) {
+        return nil, fmt.Errorf("%w: %v", ErrOutdated, err)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return hello, nil
+}
+
+// RequestIP asks the agent for its public ip.
+func RequestIP(stream io.ReadWriter) (string, error) {
+    report := new(IPReport)
+    err := RequestJson(stream, IPPath, report)
+    if err != nil {
+        return "", err
+    }
+    return report.IP, nil
+}
+
+// RequestUdp turns a fresh stream into a udp association. The datagrams the
+// agent relays back are read from the returned reader.
+func RequestUdp(stream io.ReadWriter) (*bufio.Reader, error) {
+    return RequestChannel(stream, UdpPath)
+}
+
+// RequestDns turns a fresh stream into a channel of dns messages the agent
+// answers from the resolver of its network.
+func RequestDns(stream io.ReadWriter) (*bufio.Reader, error) {
+    return RequestChannel(stream, DnsPath)
+}
+
+// RequestChannel sends the control request of path, after the answer the
+// stream carries the framed messages of that channel.
+func RequestChannel(stream io.ReadWriter, path string) (*bufio.Reader, error) {
+    req, err := WriteControlRequest(stream, path)
+    if err != nil {
+        return nil, err
+    }
+    reader := bufio.NewReader(stream)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%w: %s answered %s", ErrControlFailed, path, resp.Status)
+    }
+    return reader, nil
+}
+
+// WriteDatagram frames one datagram to or from addr in a single write, so
+// one writer per direction needs no lock.
+func WriteDatagram(w io.Writer, addr string, data []byte) error {
+    if len(addr) > 255 || len(data) > MaxDatagramSize {
+        return fmt.Errorf("datagram for %s too large", addr)
+    }
+    frame := make([]byte, 0, 4+len(addr)+len(data))
+    frame = binary.BigEndian.AppendUint16(frame, uint16(len(addr)))
+    frame = append(frame, addr...)
+    frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+    frame = append(frame, data...)
+    _, err := w.Write(frame)
+    return err
+}
+
+func ReadDatagram(r io.Reader) (string, []byte, error) {
+    var size [2]byte
+    _, err := io.ReadFull(r, size[:])
+    if err != nil {
+        return "", nil, err
+    }
+    addr := make([]byte, binary.BigEndian.Uint16(size[:]))
+    _, err = io.ReadFull(r, addr)
+    if err != nil {
+        return "", nil, err
+    }
+    _, err = io.ReadFull(r, size[:])
+    if err != nil {
+        return "", nil, err
+    }
+    data := make([]byte, binary.BigEndian.Uint16(size[:]))
+    _, err = io.ReadFull(r, data)
+    if err != nil {
+        return "", nil, err
+    }
+    return string(addr), data, nil
+}
+
+// WriteDnsMessage frames a dns message like dns over tcp does, with its
+// 2 byte length in front.
+func WriteDnsMessage(w io.Writer, msg []byte) error {
+    if len(msg) > MaxDatagramSize {
+        return errors.New("dns message too large")
+    }
+    frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+    _, err := w.Write(append(frame, msg...))
+    return err
+}
+
+func ReadDnsMessage(r io.Reader) ([]byte, error) {
+    var size [2]byte
+    _, err := io.ReadFull(r, size[:])
+    if err != nil {
+        return nil, err
+    }
+    msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+    _, err = io.ReadFull(r, msg)
+    if err != nil {
+        return nil, err
+    }
+    return msg, nil
+}
@@ -0,0 +1,223 @@
+package wire
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/elazarl/goproxy"
+)
+
+func TestRequestJson(t *testing.T) {
+    req := &Request{
+        Version: Version,
+        Host:    "1.2.3.4:22",
+        Tunnel:  "localhost:4000",
+        Key:     "key",
+        User:    "user",
+        Egress:  &EgressPolicy{DenyCidrs: []string{"10.0.0.0/8"}},
+        Mode:    ModeSocks5,
+    }
+    req.Capabilities = req.Required()
+    payload, err := json.Marshal(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var fields map[string]interface{}
+    err = json.Unmarshal(payload, &fields)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for key, value := range map[string]interface{}{"host": "1.2.3.4:22", "tunnel": "localhost:4000", "key": "key", "user": "user", "mode": ModeSocks5} {
+        if fields[key] != value {
+            t.Errorf("%s is %v in %s", key, fields[key], payload)
+        }
+    }
+
+    var decoded Request
+    err = json.Unmarshal(payload, &decoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Host != req.Host || decoded.Tunnel != req.Tunnel || decoded.Egress == nil || decoded.Mode != req.Mode {
+        t.Fatalf("decoded %+v", decoded)
+    }
+
+    // an empty payload means the http mode
+    var empty Request
+    if err = json.Unmarshal([]byte("{}"), &empty); err != nil || ModeName(empty.Mode) != ModeHttp {
+        t.Fatalf("empty payload mode %q: %v", empty.Mode, err)
+    }
+}
+
+func TestRequired(t *testing.T) {
+    req := &Request{}
+    if got := strings.Join(req.Required(), ","); got != "http,exit,dial" {
+        t.Fatalf("required %s", got)
+    }
+    req = &Request{Mode: ModeForward, Egress: &EgressPolicy{}}
+    if got := strings.Join(req.Required(), ","); got != "forward,exit,dial,egress" {
+        t.Fatalf("required %s", got)
+    }
+}
+
+func TestHelloCheck(t *testing.T) {
+    required := []string{ModeSocks5, CapExit, CapEgress}
+    tests := []struct {
+        Name     string
+        Hello    Hello
+        Outdated bool
+    }{
+        {"current", Hello{Version: Version, Capabilities: []string{ModeHttp, ModeSocks5, CapEgress, CapExit}}, false},
+        {"newer", Hello{Version: Version + 1, Capabilities: []string{ModeSocks5, CapEgress, CapExit, "future"}}, false},
+        {"old version", Hello{Version: MinVersion - 1, Capabilities: []string{ModeSocks5, CapEgress, CapExit}}, true},
+        {"no mode", Hello{Version: Version, Capabilities: []string{ModeHttp, CapEgress, CapExit}}, true},
+        {"no egress", Hello{Version: Version, Capabilities: []string{ModeSocks5, CapExit}}, true},
+    }
+    for _, test := range tests {
+        err := test.Hello.Check(required)
+        if test.Outdated != errors.Is(err, ErrOutdated) {
+            t.Errorf("%s: check returned %v", test.Name, err)
+        }
+    }
+}
+
+func TestPeekControl(t *testing.T) {
+    tests := map[string]string{
+        "GET " + HelloPath + " HTTP/1.1\r\nHost: lambdaproxy\r\n\r\n": HelloPath,
+        "GET " + ExitPath + " HTTP/1.1\r\nHost: lambdaproxy\r\n\r\n":  ExitPath,
+        "GET " + UdpPath + " HTTP/1.1\r\nHost: lambdaproxy\r\n\r\n":   UdpPath,
+        "GET " + DnsPath + " HTTP/1.1\r\nHost: lambdaproxy\r\n\r\n":   DnsPath,
+        "GET http://example.com/ HTTP/1.1\r\n\r\n":                     "",
+        "CONNECT example.com:443 HTTP/1.1\r\n\r\n":                     "",
+        "\x05\x01\x00":                                                 "",
+        "G":                                                            "",
+    }
+    for stream, path := range tests {
+        reader := bufio.NewReader(strings.NewReader(stream))
+        if got := PeekControl(reader); got != path {
+            t.Errorf("%q: got %q, want %q", stream, got, path)
+        }
+        // peeking leaves the stream to the proxy handler
+        if reader.Buffered() != len(stream) {
+            t.Errorf("%q: peek consumed the stream", stream)
+        }
+    }
+}
+
+func TestHandshake(t *testing.T) {
+    server, agent := net.Pipe()
+    defer server.Close()
+
+    go func() {
+        defer agent.Close()
+        reader := bufio.NewReader(agent)
+        if PeekControl(reader) != HelloPath {
+            return
+        }
+        _ = WriteHello(agent, &Hello{Version: Version, Capabilities: []string{ModeHttp, CapExit}})
+    }()
+
+    hello, err := RequestHello(server)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hello.Version != Version || hello.Check([]string{ModeHttp, CapExit}) != nil {
+        t.Fatalf("unexpected hello %+v", hello)
+    }
+}
+
+// A v1 http agent hands the hello request to goproxy, which refuses
+// requests that aren't proxy requests.
+func TestHandshakeV1Agent(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go http.Serve(ln, goproxy.NewProxyHttpServer())
+
+    conn, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    _, err = RequestHello(conn)
+    if !errors.Is(err, ErrOutdated) {
+        t.Fatalf("v1 agent not detected: %v", err)
+    }
+}
+
+func TestDatagram(t *testing.T) {
+    var buf bytes.Buffer
+    datagrams := []struct {
+        Addr string
+        Data []byte
+    }{
+        {"1.1.1.1:53", []byte("query")},
+        {"example.com:443", nil},
+        {"[2001:db8::1]:3478", bytes.Repeat([]byte{0xff}, MaxDatagramSize)},
+    }
+    for _, v := range datagrams {
+        if err := WriteDatagram(&buf, v.Addr, v.Data); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, v := range datagrams {
+        addr, data, err := ReadDatagram(&buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if addr != v.Addr || !bytes.Equal(data, v.Data) {
+            t.Errorf("got %s %d bytes, want %s %d bytes", addr, len(data), v.Addr, len(v.Data))
+        }
+    }
+    if err := WriteDatagram(&buf, "a:1", make([]byte, MaxDatagramSize+1)); err == nil {
+        t.Error("oversized datagram written")
+    }
+}
+
+func TestStreamHeader(t *testing.T) {
+    var buf bytes.Buffer
+    sent := StreamHeader{Target: "example.com:443", User: "alice", Flags: FlagRaw}
+    err := WriteStreamHeader(&buf, &sent)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // a field from a newer server is skipped
+    frame := buf.Bytes()
+    fields := AppendField(frame[3:], 0x7f, "later")
+    frame = append([]byte{StreamHeaderMagic, byte(len(fields) >> 8), byte(len(fields))}, fields...)
+
+    reader := bufio.NewReader(bytes.NewReader(append(frame, "payload"...)))
+    if !PeekStreamHeader(reader) || PeekControl(reader) != "" {
+        t.Fatal("stream header not told apart")
+    }
+    header, err := ReadStreamHeader(reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if *header != sent {
+        t.Errorf("header %+v, want %+v", *header, sent)
+    }
+    if rest, _ := io.ReadAll(reader); string(rest) != "payload" {
+        t.Errorf("header consumed %q", rest)
+    }
+
+    for _, code := range []byte{DialOk, DialDenied, DialFailed} {
+        buf.Reset()
+        _ = WriteDialReply(&buf, code)
+        err = ReadDialReply(&buf)
+        if (code == DialOk) != (err == nil) {
+            t.Errorf("reply %d: %v", code, err)
+        }
+    }
+}